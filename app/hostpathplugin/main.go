@@ -18,6 +18,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 
 	"github.com/kubernetes-csi/drivers/pkg/hostpath"
@@ -28,9 +29,14 @@ func init() {
 }
 
 var (
-	endpoint   = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
-	driverName = flag.String("drivername", "csi-hostpath", "name of the driver")
-	nodeID     = flag.String("nodeid", "", "node id")
+	endpoint      = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
+	driverName    = flag.String("drivername", "csi-hostpath", "name of the driver")
+	nodeID        = flag.String("nodeid", "", "node id")
+	stateDir      = flag.String("statedir", "/var/lib/csi-hostpath", "directory where the volume catalog is kept")
+	provisionRoot = flag.String("provisionroot", "/tmp/", "directory volumes of the default pool are created in")
+	pools         = flag.String("pools", "", "additional pools as comma separated name=directory pairs, selected by the \"pool\" StorageClass parameter")
+	capacityMode  = flag.String("capacitymode", "", "how volume capacity is enforced: \"\" (not enforced), \"loop\" or \"xfsquota\"")
+	topology      = flag.String("topology", "", "topology segments of the node as comma separated key=value pairs, e.g. \"topology.hostpath.csi/zone=zone-a\"")
 )
 
 func main() {
@@ -41,6 +47,16 @@ func main() {
 }
 
 func handle() {
+	poolDirs, err := hostpath.ParsePools(*provisionRoot, *pools)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	segments, err := hostpath.ParseTopology(*topology)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
 	driver := hostpath.GetHostPathDriver()
-	driver.Run(*driverName, *nodeID, *endpoint)
+	driver.Run(*driverName, *nodeID, *endpoint, *stateDir, *capacityMode, poolDirs, segments)
 }
@@ -20,6 +20,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -27,8 +28,12 @@ import (
 )
 
 var (
-	endpoint string
-	nodeID   string
+	endpoint            string
+	nodeID              string
+	workingMountDir     string
+	stateDir            string
+	credentialsDir      string
+	healthCheckInterval time.Duration
 )
 
 func init() {
@@ -55,6 +60,14 @@ func main() {
 	cmd.PersistentFlags().StringVar(&endpoint, "endpoint", "", "CSI endpoint")
 	cmd.MarkPersistentFlagRequired("endpoint")
 
+	cmd.PersistentFlags().DurationVar(&healthCheckInterval, "healthcheckinterval", time.Minute, "how often NFS mounts are probed for stale handles, 0 disables probing")
+
+	cmd.PersistentFlags().StringVar(&workingMountDir, "workingmountdir", "/tmp/csi-nfs", "directory the controller temporarily mounts base exports in")
+
+	cmd.PersistentFlags().StringVar(&stateDir, "statedir", "/var/lib/csi-nfs/state", "directory recording the targets staged volumes are published at")
+
+	cmd.PersistentFlags().StringVar(&credentialsDir, "credentialsdir", "/var/lib/csi-nfs/krb5", "directory holding the Kerberos credentials of node mounts")
+
 	cmd.ParseFlags(os.Args[1:])
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "%s", err.Error())
@@ -65,6 +78,6 @@ func main() {
 }
 
 func handle() {
-	d := nfs.NewDriver(nodeID, endpoint)
+	d := nfs.NewDriver(nodeID, endpoint, workingMountDir, stateDir, credentialsDir, healthCheckInterval)
 	d.Run()
 }
@@ -0,0 +1,38 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// RecordingMounter is a fake mounter for the tests of the drivers. It also
+// records the options of each mount, which FakeMounter drops.
+type RecordingMounter struct {
+	*mount.FakeMounter
+	// Opts holds the options of the last mount of each target
+	Opts map[string][]string
+}
+
+func NewRecordingMounter() *RecordingMounter {
+	return &RecordingMounter{FakeMounter: &mount.FakeMounter{}, Opts: map[string][]string{}}
+}
+
+func (m *RecordingMounter) Mount(source, target, fstype string, options []string) error {
+	m.Opts[target] = options
+	return m.FakeMounter.Mount(source, target, fstype, options)
+}
@@ -18,6 +18,7 @@ package csicommon
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
@@ -94,7 +95,7 @@ func RunControllerandNodePublishServer(endpoint string, d *CSIDriver, cs csi.Con
 
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	glog.V(3).Infof("GRPC call: %s", info.FullMethod)
-	glog.V(5).Infof("GRPC request: %+v", req)
+	glog.V(5).Infof("GRPC request: %+v", stripSecrets(req))
 	resp, err := handler(ctx, req)
 	if err != nil {
 		glog.Errorf("GRPC error: %v", err)
@@ -103,3 +104,51 @@ func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h
 	}
 	return resp, err
 }
+
+// strippedSecret replaces the values of secrets in logged requests
+const strippedSecret = "***stripped***"
+
+// secretAttribute is the volume attribute deprecated drivers take secrets
+// from, e.g. the CHAP credentials of iSCSI volumes
+const secretAttribute = "secret"
+
+// stripSecrets returns a copy of a CSI request in which the values of all
+// secrets, i.e. of map fields named *Secrets and of the secretAttribute of
+// VolumeAttributes, are replaced so that the request can be logged. Other
+// requests are returned unchanged.
+func stripSecrets(req interface{}) interface{} {
+	v := reflect.ValueOf(req)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return req
+	}
+	stripped := reflect.New(v.Elem().Type())
+	stripped.Elem().Set(v.Elem())
+	t := v.Elem().Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := stripped.Elem().Field(i)
+		if field.Type() != reflect.TypeOf(map[string]string{}) || field.Len() == 0 {
+			continue
+		}
+		name := t.Field(i).Name
+		switch {
+		case strings.HasSuffix(name, "Secrets"):
+			secrets := map[string]string{}
+			for _, key := range field.MapKeys() {
+				secrets[key.String()] = strippedSecret
+			}
+			field.Set(reflect.ValueOf(secrets))
+		case name == "VolumeAttributes":
+			attributes := field.Interface().(map[string]string)
+			if _, ok := attributes[secretAttribute]; !ok {
+				continue
+			}
+			copied := map[string]string{}
+			for key, value := range attributes {
+				copied[key] = value
+			}
+			copied[secretAttribute] = strippedSecret
+			field.Set(reflect.ValueOf(copied))
+		}
+	}
+	return stripped.Interface()
+}
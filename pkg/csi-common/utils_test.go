@@ -17,8 +17,10 @@ limitations under the License.
 package csicommon
 
 import (
+	"fmt"
 	"testing"
 
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -74,3 +76,36 @@ func TestParseEndpoint(t *testing.T) {
 	_, _, err = ParseEndpoint("")
 	assert.NotNil(t, err)
 }
+
+func TestStripSecrets(t *testing.T) {
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:           "vol",
+		VolumeAttributes:   map[string]string{"server": "10.0.0.1"},
+		NodePublishSecrets: map[string]string{"password": "secret"},
+	}
+
+	stripped := stripSecrets(req)
+	logged := fmt.Sprintf("%+v", stripped)
+	assert.NotContains(t, logged, ":secret")
+	assert.Contains(t, logged, strippedSecret)
+	assert.Contains(t, logged, "10.0.0.1")
+	assert.Equal(t, "vol", stripped.(*csi.NodePublishVolumeRequest).GetVolumeId())
+
+	// Test that the request itself is unchanged
+	assert.Equal(t, "secret", req.GetNodePublishSecrets()["password"])
+
+	// Test that the deprecated secret attribute is stripped as well
+	stageReq := &csi.NodeStageVolumeRequest{
+		VolumeId:         "vol",
+		VolumeAttributes: map[string]string{"portal": "10.0.0.1:3260", secretAttribute: `{"password":"chap"}`},
+	}
+	logged = fmt.Sprintf("%+v", stripSecrets(stageReq))
+	assert.NotContains(t, logged, "chap")
+	assert.Contains(t, logged, strippedSecret)
+	assert.Contains(t, logged, "10.0.0.1:3260")
+	assert.Contains(t, stageReq.GetVolumeAttributes()[secretAttribute], "chap")
+
+	// Test requests without secrets
+	assert.Equal(t, &csi.NodeGetIdRequest{}, stripSecrets(&csi.NodeGetIdRequest{}))
+	assert.Nil(t, stripSecrets(nil))
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// Capacity modes select how the size of a hostpath volume is enforced.
+const (
+	// capacityModeNone provisions plain directories, the requested size is
+	// only recorded.
+	capacityModeNone = ""
+	// capacityModeLoop backs every volume with a sparse image file of the
+	// requested size, formatted and loop mounted on the volume directory.
+	capacityModeLoop = "loop"
+	// capacityModeXFSQuota limits every volume directory with an XFS
+	// project quota. The provision root must be on XFS mounted with prjquota.
+	capacityModeXFSQuota = "xfsquota"
+
+	defaultVolumeSize = gib
+	loopFsType        = "ext4"
+	xfsSuperMagic     = 0x58465342
+	firstXFSProjectID = 1000
+)
+
+func validateCapacityMode(mode, root string) error {
+	switch mode {
+	case capacityModeNone, capacityModeLoop:
+		return nil
+	case capacityModeXFSQuota:
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(root, &st); err != nil {
+			return fmt.Errorf("hostpath: failed to statfs %s: %v", root, err)
+		}
+		if st.Type != xfsSuperMagic {
+			return fmt.Errorf("hostpath: capacity mode %q requires %s to be on XFS", mode, root)
+		}
+		return nil
+	}
+	return fmt.Errorf("hostpath: unknown capacity mode %q", mode)
+}
+
+// setupVolumeBacking makes sure that vol.VolPath cannot grow beyond
+// vol.VolSize. The volume directory must already exist.
+func setupVolumeBacking(vol *hostPathVolume, mode string) error {
+	switch mode {
+	case capacityModeLoop:
+		image := vol.VolPath + ".img"
+		if err := createImage(image, vol.VolSize); err != nil {
+			return err
+		}
+		if out, err := exec.Command("mkfs."+loopFsType, "-F", "-q", image).CombinedOutput(); err != nil {
+			os.Remove(image)
+			return fmt.Errorf("hostpath: failed to format %s: %v: %s", image, err, string(out))
+		}
+		if err := mount.New("").Mount(image, vol.VolPath, loopFsType, []string{"loop"}); err != nil {
+			os.Remove(image)
+			return fmt.Errorf("hostpath: failed to mount %s: %v", image, err)
+		}
+		vol.VolBacking = capacityModeLoop
+		vol.VolImage = image
+	case capacityModeXFSQuota:
+		projectID := store.nextXFSProjectID()
+		if err := setXFSQuota(vol.VolPath, projectID, vol.VolSize); err != nil {
+			return err
+		}
+		vol.VolBacking = capacityModeXFSQuota
+		vol.VolProjectID = projectID
+	}
+	return nil
+}
+
+// restoreVolumeBacking remounts the image of a loop backed volume after a
+// node reboot. It is a no-op for the other capacity modes.
+func restoreVolumeBacking(vol hostPathVolume) error {
+	if vol.VolBacking != capacityModeLoop {
+		return nil
+	}
+	mounter := mount.New("")
+	notMnt, err := mount.IsNotMountPoint(mounter, vol.VolPath)
+	if err != nil {
+		return err
+	}
+	if !notMnt {
+		return nil
+	}
+	glog.V(4).Infof("hostpath: remounting %s on %s", vol.VolImage, vol.VolPath)
+	return mounter.Mount(vol.VolImage, vol.VolPath, loopFsType, []string{"loop"})
+}
+
+// teardownVolumeBacking releases whatever setupVolumeBacking created. The
+// volume directory itself is left to the caller.
+func teardownVolumeBacking(vol hostPathVolume) error {
+	switch vol.VolBacking {
+	case capacityModeLoop:
+		mounter := mount.New("")
+		notMnt, err := mount.IsNotMountPoint(mounter, vol.VolPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && !notMnt {
+			if err := mounter.Unmount(vol.VolPath); err != nil {
+				return fmt.Errorf("hostpath: failed to unmount %s: %v", vol.VolPath, err)
+			}
+		}
+		if err := os.Remove(vol.VolImage); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	case capacityModeXFSQuota:
+		if _, err := os.Stat(vol.VolPath); os.IsNotExist(err) {
+			return nil
+		}
+		return setXFSQuota(vol.VolPath, vol.VolProjectID, 0)
+	}
+	return nil
+}
+
+// createImage creates a sparse file of the given size.
+func createImage(image string, size int64) error {
+	fp, err := os.OpenFile(image, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("hostpath: failed to create %s: %v", image, err)
+	}
+	defer fp.Close()
+	if err := fp.Truncate(size); err != nil {
+		os.Remove(image)
+		return fmt.Errorf("hostpath: failed to resize %s: %v", image, err)
+	}
+	return nil
+}
+
+// setXFSQuota assigns path to the XFS project and sets its hard block limit,
+// a limit of 0 removes the limit.
+func setXFSQuota(path string, projectID uint32, size int64) error {
+	fsRoot, err := findMountPoint(path)
+	if err != nil {
+		return err
+	}
+	cmds := []string{
+		fmt.Sprintf("project -s -p %s %d", path, projectID),
+		fmt.Sprintf("limit -p bhard=%d %d", size, projectID),
+	}
+	for _, cmd := range cmds {
+		if out, err := exec.Command("xfs_quota", "-x", "-c", cmd, fsRoot).CombinedOutput(); err != nil {
+			return fmt.Errorf("hostpath: xfs_quota %q failed: %v: %s", cmd, err, string(out))
+		}
+	}
+	return nil
+}
+
+// findMountPoint returns the mount point of the filesystem holding path.
+func findMountPoint(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", err
+	}
+	for path != "/" {
+		parent := filepath.Dir(path)
+		var pst syscall.Stat_t
+		if err := syscall.Stat(parent, &pst); err != nil {
+			return "", err
+		}
+		if pst.Dev != st.Dev {
+			break
+		}
+		path = parent
+	}
+	return path, nil
+}
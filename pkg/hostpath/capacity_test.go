@@ -0,0 +1,47 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCapacityMode(t *testing.T) {
+	assert.NoError(t, validateCapacityMode(capacityModeNone, os.TempDir()))
+	assert.NoError(t, validateCapacityMode(capacityModeLoop, os.TempDir()))
+	assert.Error(t, validateCapacityMode("bogus", os.TempDir()))
+}
+
+func TestCreateImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostpath-image")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "vol.img")
+	assert.NoError(t, createImage(image, 10*mib))
+	fi, err := os.Stat(image)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*mib, fi.Size())
+
+	// Test that an existing image is not overwritten
+	assert.Error(t, createImage(image, mib))
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/pborman/uuid"
+)
+
+const (
+	volumesFile   = "volumes.json"
+	snapshotsFile = "snapshots.json"
+)
+
+// volumeCatalog keeps the lists of hostpath volumes and snapshots in JSON
+// files under the state directory so that they survive plugin restarts. The
+// files are always replaced atomically, a crash leaves either the old or the
+// new list.
+type volumeCatalog struct {
+	dir string
+}
+
+func newVolumeCatalog(stateDir string) (*volumeCatalog, error) {
+	if err := os.MkdirAll(stateDir, 0750); err != nil {
+		return nil, fmt.Errorf("hostpath: failed to create state dir %s: %v", stateDir, err)
+	}
+	return &volumeCatalog{dir: stateDir}, nil
+}
+
+func (c *volumeCatalog) loadVolumes() (map[string]hostPathVolume, error) {
+	vols := map[string]hostPathVolume{}
+	if err := c.read(volumesFile, &vols); err != nil {
+		return nil, err
+	}
+	return vols, nil
+}
+
+func (c *volumeCatalog) saveVolumes(vols map[string]hostPathVolume) error {
+	return c.write(volumesFile, vols)
+}
+
+func (c *volumeCatalog) loadSnapshots() (map[string]hostPathSnapshot, error) {
+	snaps := map[string]hostPathSnapshot{}
+	if err := c.read(snapshotsFile, &snaps); err != nil {
+		return nil, err
+	}
+	return snaps, nil
+}
+
+func (c *volumeCatalog) saveSnapshots(snaps map[string]hostPathSnapshot) error {
+	return c.write(snapshotsFile, snaps)
+}
+
+// read decodes the named file into v. A missing file is not an error and
+// leaves v untouched.
+func (c *volumeCatalog) read(name string, v interface{}) error {
+	file := filepath.Join(c.dir, name)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("hostpath: failed to read catalog %s: %v", file, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("hostpath: failed to decode catalog %s: %v", file, err)
+	}
+	return nil
+}
+
+// write encodes v to a temporary file, syncs it and renames it over the
+// named file.
+func (c *volumeCatalog) write(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("hostpath: failed to encode catalog: %v", err)
+	}
+
+	file := filepath.Join(c.dir, name)
+	tmp := file + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("hostpath: failed to create %s: %v", tmp, err)
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return fmt.Errorf("hostpath: failed to write %s: %v", tmp, err)
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return fmt.Errorf("hostpath: failed to sync %s: %v", tmp, err)
+	}
+	if err := fp.Close(); err != nil {
+		return fmt.Errorf("hostpath: failed to close %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return fmt.Errorf("hostpath: failed to rename %s: %v", tmp, err)
+	}
+
+	// Sync the directory as well so that the rename itself is durable.
+	if dir, err := os.Open(c.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// reconcileVolumes drops catalog entries whose directory is gone and reports
+// volume directories under root which are not known to the catalog.
+func reconcileVolumes(vols map[string]hostPathVolume, root string) {
+	for id, vol := range vols {
+		if _, err := os.Stat(vol.VolPath); os.IsNotExist(err) {
+			glog.Warningf("hostpath: volume %s (%s) missing at %s, dropping it from the catalog", id, vol.VolName, vol.VolPath)
+			delete(vols, id)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		glog.Warningf("hostpath: failed to read provision root %s: %v", root, err)
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() || uuid.Parse(e.Name()) == nil {
+			continue
+		}
+		if _, ok := vols[e.Name()]; !ok {
+			glog.Warningf("hostpath: directory %s is not in the catalog", filepath.Join(root, e.Name()))
+		}
+	}
+}
+
+// reconcileSnapshots drops catalog entries whose archive is gone.
+func reconcileSnapshots(snaps map[string]hostPathSnapshot) {
+	for id, snap := range snaps {
+		if _, err := os.Stat(snap.Path); os.IsNotExist(err) {
+			glog.Warningf("hostpath: snapshot %s (%s) missing at %s, dropping it from the catalog", id, snap.Name, snap.Path)
+			delete(snaps, id)
+		}
+	}
+}
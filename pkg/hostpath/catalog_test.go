@@ -0,0 +1,75 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalogSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostpath-catalog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := newVolumeCatalog(filepath.Join(dir, "state"))
+	assert.NoError(t, err)
+
+	// Test missing catalog files
+	vols, err := c.loadVolumes()
+	assert.NoError(t, err)
+	assert.Zero(t, len(vols))
+	snaps, err := c.loadSnapshots()
+	assert.NoError(t, err)
+	assert.Zero(t, len(snaps))
+
+	// Test round trip
+	vols["id1"] = hostPathVolume{VolName: "vol1", VolID: "id1", VolSize: mib, VolPath: "/tmp/id1"}
+	assert.NoError(t, c.saveVolumes(vols))
+	loaded, err := c.loadVolumes()
+	assert.NoError(t, err)
+	assert.Equal(t, vols, loaded)
+
+	snaps["snap1"] = hostPathSnapshot{Name: "snap1", Id: "snap1", VolID: "id1", Path: "/tmp/snap1.tgz", ReadyToUse: true}
+	assert.NoError(t, c.saveSnapshots(snaps))
+	loadedSnaps, err := c.loadSnapshots()
+	assert.NoError(t, err)
+	assert.Equal(t, snaps, loadedSnaps)
+}
+
+func TestReconcileVolumes(t *testing.T) {
+	root, err := ioutil.TempDir("", "hostpath-root")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	present := filepath.Join(root, "present")
+	assert.NoError(t, os.MkdirAll(present, 0750))
+
+	vols := map[string]hostPathVolume{
+		"present": {VolName: "a", VolID: "present", VolPath: present},
+		"missing": {VolName: "b", VolID: "missing", VolPath: filepath.Join(root, "missing")},
+	}
+	reconcileVolumes(vols, root)
+
+	assert.Equal(t, 1, len(vols))
+	_, ok := vols["present"]
+	assert.True(t, ok)
+}
@@ -19,6 +19,10 @@ package hostpath
 import (
 	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/pborman/uuid"
@@ -31,13 +35,21 @@ import (
 )
 
 const (
-	deviceID           = "deviceID"
-	provisionRoot      = "/tmp/"
-	maxStorageCapacity = tib
+	deviceID    = "deviceID"
+	snapshotDir = "snapshots"
+	// sourceVolumeParameter selects a volume to clone. It can be replaced by
+	// the volume content source once the CSI spec supports volume sources.
+	sourceVolumeParameter = "sourceVolumeID"
+	maxStorageCapacity    = tib
 )
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
+	capacityMode string
+	// pools maps pool names to the directories volumes are created in
+	pools map[string]string
+	// topology holds the segments of the node volumes are created on
+	topology map[string]string
 }
 
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
@@ -53,49 +65,184 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if req.GetVolumeCapabilities() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
 	}
+	// Check the requested access type
+	accessType := mountAccess
+	for _, cap := range req.GetVolumeCapabilities() {
+		if cap.GetBlock() != nil {
+			accessType = blockAccess
+		}
+	}
+	for _, cap := range req.GetVolumeCapabilities() {
+		if accessType == blockAccess && cap.GetMount() != nil {
+			return nil, status.Error(codes.InvalidArgument, "Cannot have both block and mount access type")
+		}
+	}
+	pool := req.GetParameters()[poolParameter]
+	root, ok := cs.pools[pool]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Unknown pool %q", pool)
+	}
+	sourceVolumeID := req.GetParameters()[sourceVolumeParameter]
+	snapshotID := req.GetVolumeContentSource().GetSnapshot().GetId()
+	if len(sourceVolumeID) != 0 && len(snapshotID) != 0 {
+		return nil, status.Error(codes.InvalidArgument, "Cannot create a volume from both a snapshot and a volume")
+	}
+	// Serialize operations on the volume name and keep the source volume or
+	// snapshot from being deleted while it is copied
+	lockKeys := []string{volumeNameKey(req.GetName())}
+	if len(sourceVolumeID) != 0 {
+		lockKeys = append(lockKeys, volumeIDKey(sourceVolumeID))
+	}
+	if len(snapshotID) != 0 {
+		lockKeys = append(lockKeys, snapshotIDKey(snapshotID))
+	}
+	if !store.tryLock(lockKeys...) {
+		return nil, status.Errorf(codes.Aborted, "An operation for volume %s is already in progress", req.GetName())
+	}
+	defer store.unlock(lockKeys...)
 	// Need to check for already existing volume name, and if found
 	// check for the requested capacity and already allocated capacity
-	if exVol, err := getVolumeByName(req.GetName()); err == nil {
+	if exVol, err := store.getVolumeByName(req.GetName()); err == nil {
 		// Since err is nil, it means the volume with the same name already exists
 		// need to check if the size of exisiting volume is the same as in new
 		// request
-		if exVol.VolSize >= int64(req.GetCapacityRange().GetRequiredBytes()) {
+		if exVol.VolSize >= int64(req.GetCapacityRange().GetRequiredBytes()) && exVol.VolAccessType == accessType && exVol.VolPool == pool &&
+			exVol.VolSourceVolumeID == sourceVolumeID && exVol.VolSourceSnapshotID == snapshotID &&
+			requirementSatisfied(exVol.VolTopology, req.GetAccessibilityRequirements()) {
 			// exisiting volume is compatible with new request and should be reused.
 			// TODO (sbezverk) Do I need to make sure that RBD volume still exists?
 			return &csi.CreateVolumeResponse{
 				Volume: &csi.Volume{
-					Id:            exVol.VolID,
-					CapacityBytes: int64(exVol.VolSize),
-					Attributes:    req.GetParameters(),
+					Id:                 exVol.VolID,
+					CapacityBytes:      int64(exVol.VolSize),
+					Attributes:         req.GetParameters(),
+					AccessibleTopology: accessibleTopology(exVol.VolTopology),
 				},
 			}, nil
 		}
-		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different size already exist", req.GetName()))
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different size, access type, pool, source or topology already exist", req.GetName()))
+	}
+	// Volumes are created on this node, which must satisfy the requested
+	// topology
+	if !requirementSatisfied(cs.topology, req.GetAccessibilityRequirements()) {
+		return nil, status.Errorf(codes.ResourceExhausted, "Node topology %v does not satisfy the accessibility requirements", cs.topology)
 	}
 	// Check for maximum available capacity
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
 	if capacity >= maxStorageCapacity {
 		return nil, status.Errorf(codes.OutOfRange, "Requested capacity %d exceeds maximum allowed %d", capacity, maxStorageCapacity)
 	}
-	volumeID := uuid.NewUUID().String()
-	path := provisionRoot + volumeID
-	err := os.MkdirAll(path, 0777)
-	if err != nil {
-		glog.V(3).Infof("failed to create volume: %v", err)
-		return nil, err
+	// Look up the volume to clone, if any
+	var sourceVol *hostPathVolume
+	if len(sourceVolumeID) != 0 {
+		vol, err := store.getVolumeByID(sourceVolumeID)
+		if err != nil {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		if vol.VolAccessType != accessType {
+			return nil, status.Errorf(codes.InvalidArgument, "Source volume %s has access type %s, not %s", sourceVolumeID, vol.VolAccessType, accessType)
+		}
+		if capacity == 0 {
+			capacity = vol.VolSize
+		}
+		if capacity < vol.VolSize {
+			return nil, status.Errorf(codes.OutOfRange, "Requested capacity %d is smaller than source volume size %d", capacity, vol.VolSize)
+		}
+		sourceVol = &vol
 	}
-	glog.V(4).Infof("create volume %s", path)
+	if capacity == 0 && (cs.capacityMode != capacityModeNone || accessType == blockAccess) {
+		capacity = defaultVolumeSize
+	}
+	// Look up the snapshot to restore from, if any
+	var snapshot *hostPathSnapshot
+	if len(snapshotID) != 0 {
+		if accessType == blockAccess {
+			return nil, status.Error(codes.InvalidArgument, "Cannot restore a snapshot into a block volume")
+		}
+		snap, err := store.getSnapshotByID(snapshotID)
+		if err != nil {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		if !snap.ReadyToUse {
+			return nil, status.Errorf(codes.Unavailable, "Snapshot %s is not ready to use", snapshotID)
+		}
+		snapshot = &snap
+	}
+	volumeID := uuid.NewUUID().String()
+	path := filepath.Join(root, volumeID)
 	hostPathVol := hostPathVolume{}
 	hostPathVol.VolName = req.GetName()
 	hostPathVol.VolID = volumeID
 	hostPathVol.VolSize = capacity
 	hostPathVol.VolPath = path
-	hostPathVolumes[volumeID] = hostPathVol
+	hostPathVol.VolAccessType = accessType
+	hostPathVol.VolPool = pool
+	hostPathVol.VolSourceVolumeID = sourceVolumeID
+	hostPathVol.VolSourceSnapshotID = snapshotID
+	hostPathVol.VolTopology = cs.topology
+	if accessType == blockAccess {
+		// A block volume is a sparse file attached to a loop device
+		var err error
+		if sourceVol != nil {
+			err = cloneBlockVolume(*sourceVol, path, capacity)
+		} else {
+			err = createImage(path, capacity)
+		}
+		if err != nil {
+			glog.V(3).Infof("failed to create block volume: %v", err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if _, err := attachLoopDevice(path); err != nil {
+			glog.V(3).Infof("failed to create block volume: %v", err)
+			os.Remove(path)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.V(4).Infof("create block volume %s", path)
+	} else {
+		err := os.MkdirAll(path, 0777)
+		if err != nil {
+			glog.V(3).Infof("failed to create volume: %v", err)
+			return nil, err
+		}
+		glog.V(4).Infof("create volume %s", path)
+		if err := setupVolumeBacking(&hostPathVol, cs.capacityMode); err != nil {
+			glog.V(3).Infof("failed to set up backing of volume %s: %v", volumeID, err)
+			os.RemoveAll(path)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if sourceVol != nil && accessType == mountAccess {
+		if err := cloneVolume(*sourceVol, path); err != nil {
+			glog.V(3).Infof("failed to clone volume %s: %v", sourceVol.VolID, err)
+			teardownVolumeBacking(hostPathVol)
+			os.RemoveAll(path)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.V(4).Infof("cloned volume %s into volume %s", sourceVol.VolID, path)
+	}
+	if snapshot != nil {
+		if err := restoreSnapshot(*snapshot, path); err != nil {
+			glog.V(3).Infof("failed to restore snapshot %s: %v", snapshot.Id, err)
+			teardownVolumeBacking(hostPathVol)
+			os.RemoveAll(path)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.V(4).Infof("restored snapshot %s into volume %s", snapshot.Id, path)
+	}
+	if err := store.addVolume(hostPathVol); err != nil {
+		glog.V(3).Infof("failed to persist volume %s: %v", volumeID, err)
+		teardownVolumeBacking(hostPathVol)
+		detachLoopDevice(path)
+		os.RemoveAll(path)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			Id:            volumeID,
-			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
-			Attributes:    req.GetParameters(),
+			Id:                 volumeID,
+			CapacityBytes:      capacity,
+			Attributes:         req.GetParameters(),
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: accessibleTopology(cs.topology),
 		},
 	}, nil
 }
@@ -112,10 +259,31 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		return nil, err
 	}
 	volumeID := req.VolumeId
+	if !store.tryLock(volumeIDKey(volumeID)) {
+		return nil, status.Errorf(codes.Aborted, "An operation for volume %s is already in progress", volumeID)
+	}
+	defer store.unlock(volumeIDKey(volumeID))
 	glog.V(4).Infof("deleting volume %s", volumeID)
-	path := provisionRoot + volumeID
-	os.RemoveAll(path)
-	delete(hostPathVolumes, volumeID)
+	hostPathVol, err := store.getVolumeByID(volumeID)
+	if err != nil {
+		// Deleting a volume which does not exist is not an error
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	if hostPathVol.VolAccessType == blockAccess {
+		if err := detachLoopDevice(hostPathVol.VolPath); err != nil {
+			glog.V(3).Infof("failed to detach block volume %s: %v", volumeID, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := teardownVolumeBacking(hostPathVol); err != nil {
+		glog.V(3).Infof("failed to tear down backing of volume %s: %v", volumeID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	os.RemoveAll(hostPathVol.VolPath)
+	if err := store.deleteVolume(volumeID); err != nil {
+		glog.V(3).Infof("failed to persist deletion of volume %s: %v", volumeID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -129,10 +297,290 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
 	}
 
+	hostPathVol, err := store.getVolumeByID(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
 	for _, cap := range req.VolumeCapabilities {
 		if cap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
 			return &csi.ValidateVolumeCapabilitiesResponse{Supported: false, Message: ""}, nil
 		}
+		if cap.GetBlock() != nil && hostPathVol.VolAccessType != blockAccess {
+			return &csi.ValidateVolumeCapabilitiesResponse{Supported: false, Message: "Volume does not support block access"}, nil
+		}
+		if cap.GetMount() != nil && hostPathVol.VolAccessType == blockAccess {
+			return &csi.ValidateVolumeCapabilitiesResponse{Supported: false, Message: "Block volume does not support mount access"}, nil
+		}
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{Supported: true, Message: ""}, nil
 }
+
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		glog.V(3).Infof("invalid list volumes req: %v", req)
+		return nil, err
+	}
+
+	volumes := store.listVolumes()
+	start, end, nextToken, err := paginate(len(volumes), req.GetMaxEntries(), req.GetStartingToken())
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, vol := range volumes[start:end] {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				Id:                 vol.VolID,
+				CapacityBytes:      vol.VolSize,
+				AccessibleTopology: accessibleTopology(vol.VolTopology),
+			},
+		})
+	}
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		glog.V(3).Infof("invalid get capacity req: %v", req)
+		return nil, err
+	}
+
+	pool := req.GetParameters()[poolParameter]
+	root, ok := cs.pools[pool]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Unknown pool %q", pool)
+	}
+	// Nothing can be provisioned in other parts of the topology
+	if t := req.GetAccessibleTopology(); t != nil && !topologyMatches(cs.topology, t) {
+		return &csi.GetCapacityResponse{}, nil
+	}
+	available, err := getAvailableCapacity(root)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+	}, nil
+}
+
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		glog.V(3).Infof("invalid create snapshot req: %v", req)
+		return nil, err
+	}
+
+	// Check arguments
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if len(req.GetSourceVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "SourceVolumeId missing in request")
+	}
+
+	// Serialize operations on the snapshot name and keep the source volume
+	// from being deleted while it is archived
+	lockKeys := []string{snapshotNameKey(req.GetName()), volumeIDKey(req.GetSourceVolumeId())}
+	if !store.tryLock(lockKeys...) {
+		return nil, status.Errorf(codes.Aborted, "An operation for snapshot %s is already in progress", req.GetName())
+	}
+	defer store.unlock(lockKeys...)
+
+	// Need to check for already existing snapshot name, and if found
+	// check that it was taken from the same source volume
+	if exSnap, err := store.getSnapshotByName(req.GetName()); err == nil {
+		if exSnap.VolID == req.GetSourceVolumeId() {
+			return &csi.CreateSnapshotResponse{
+				Snapshot: getCSISnapshot(exSnap),
+			}, nil
+		}
+		return nil, status.Errorf(codes.AlreadyExists, "Snapshot with the same name: %s but with different SourceVolumeId already exist", req.GetName())
+	}
+
+	volumeID := req.GetSourceVolumeId()
+	hostPathVol, err := store.getVolumeByID(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if hostPathVol.VolAccessType == blockAccess {
+		return nil, status.Error(codes.InvalidArgument, "Snapshots of block volumes are not supported")
+	}
+
+	snapshotID := uuid.NewUUID().String()
+	snapshotRoot := filepath.Join(cs.pools[defaultPool], snapshotDir)
+	file := filepath.Join(snapshotRoot, snapshotID+".tgz")
+	if err := os.MkdirAll(snapshotRoot, 0750); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	creationTime := time.Now().UnixNano()
+	out, err := exec.Command("tar", "czf", file, "-C", hostPathVol.VolPath, ".").CombinedOutput()
+	if err != nil {
+		os.Remove(file)
+		return nil, status.Errorf(codes.Internal, "failed to create snapshot of volume %s: %v: %s", volumeID, err, string(out))
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	glog.V(4).Infof("create snapshot %s of volume %s", file, volumeID)
+	snapshot := hostPathSnapshot{}
+	snapshot.Name = req.GetName()
+	snapshot.Id = snapshotID
+	snapshot.VolID = volumeID
+	snapshot.Path = file
+	snapshot.CreationTime = creationTime
+	snapshot.SizeBytes = fi.Size()
+	snapshot.ReadyToUse = true
+	if err := store.addSnapshot(snapshot); err != nil {
+		glog.V(3).Infof("failed to persist snapshot %s: %v", snapshotID, err)
+		os.Remove(file)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: getCSISnapshot(snapshot),
+	}, nil
+}
+
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	// Check arguments
+	if len(req.GetSnapshotId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID missing in request")
+	}
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		glog.V(3).Infof("invalid delete snapshot req: %v", req)
+		return nil, err
+	}
+	snapshotID := req.GetSnapshotId()
+	if !store.tryLock(snapshotIDKey(snapshotID)) {
+		return nil, status.Errorf(codes.Aborted, "An operation for snapshot %s is already in progress", snapshotID)
+	}
+	defer store.unlock(snapshotIDKey(snapshotID))
+	snapshot, err := store.getSnapshotByID(snapshotID)
+	if err != nil {
+		// Deleting a snapshot which does not exist is not an error
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	glog.V(4).Infof("deleting snapshot %s", snapshotID)
+	os.Remove(snapshot.Path)
+	if err := store.deleteSnapshot(snapshotID); err != nil {
+		glog.V(3).Infof("failed to persist deletion of snapshot %s: %v", snapshotID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		glog.V(3).Infof("invalid list snapshot req: %v", req)
+		return nil, err
+	}
+
+	// A snapshot ID selects at most one snapshot
+	if snapshotID := req.GetSnapshotId(); len(snapshotID) != 0 {
+		if snapshot, err := store.getSnapshotByID(snapshotID); err == nil {
+			return &csi.ListSnapshotsResponse{
+				Entries: []*csi.ListSnapshotsResponse_Entry{
+					{Snapshot: getCSISnapshot(snapshot)},
+				},
+			}, nil
+		}
+		return &csi.ListSnapshotsResponse{}, nil
+	}
+
+	snapshots := store.listSnapshots(req.GetSourceVolumeId())
+	start, end, nextToken, err := paginate(len(snapshots), req.GetMaxEntries(), req.GetStartingToken())
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, snapshot := range snapshots[start:end] {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: getCSISnapshot(snapshot),
+		})
+	}
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// paginate returns the range [start, end) of a sorted list of total entries
+// to return for a list request, and the token of the next page if any.
+// Tokens are the decimal index of the first entry of the page.
+func paginate(total int, maxEntries int32, startingToken string) (int, int, string, error) {
+	start := 0
+	if len(startingToken) != 0 {
+		var err error
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 || start > total {
+			return 0, 0, "", status.Errorf(codes.Aborted, "Invalid starting token %s", startingToken)
+		}
+	}
+	if maxEntries < 0 {
+		return 0, 0, "", status.Errorf(codes.InvalidArgument, "Invalid max entries %d", maxEntries)
+	}
+	end := total
+	nextToken := ""
+	if maxEntries > 0 && start+int(maxEntries) < total {
+		end = start + int(maxEntries)
+		nextToken = strconv.Itoa(end)
+	}
+	return start, end, nextToken, nil
+}
+
+func getCSISnapshot(snapshot hostPathSnapshot) *csi.Snapshot {
+	snapStatus := csi.SnapshotStatus_UPLOADING
+	if snapshot.ReadyToUse {
+		snapStatus = csi.SnapshotStatus_READY
+	}
+	return &csi.Snapshot{
+		Id:             snapshot.Id,
+		SourceVolumeId: snapshot.VolID,
+		CreatedAt:      snapshot.CreationTime,
+		SizeBytes:      snapshot.SizeBytes,
+		Status: &csi.SnapshotStatus{
+			Type: snapStatus,
+		},
+	}
+}
+
+// cloneVolume copies the content of a volume directory into path, keeping
+// ownership, modes, timestamps, extended attributes and symlinks.
+func cloneVolume(source hostPathVolume, path string) error {
+	out, err := exec.Command("cp", "-a", source.VolPath+"/.", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to clone volume %s: %v: %s", source.VolID, err, string(out))
+	}
+	return nil
+}
+
+// cloneBlockVolume copies the backing file of a block volume to path and
+// grows it to size, keeping it sparse.
+func cloneBlockVolume(source hostPathVolume, path string, size int64) error {
+	out, err := exec.Command("cp", "--sparse=always", source.VolPath, path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to clone volume %s: %v: %s", source.VolID, err, string(out))
+	}
+	if err := os.Truncate(path, size); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to resize %s: %v", path, err)
+	}
+	return nil
+}
+
+// restoreSnapshot unpacks the snapshot archive into the volume directory.
+func restoreSnapshot(snapshot hostPathSnapshot, path string) error {
+	out, err := exec.Command("tar", "xzf", snapshot.Path, "-C", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to restore snapshot %s: %v: %s", snapshot.Id, err, string(out))
+	}
+	return nil
+}
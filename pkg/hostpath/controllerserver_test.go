@@ -0,0 +1,217 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+// newSnapshotControllerServer returns a controller server provisioning plain
+// directories in dir, with an empty store.
+func newSnapshotControllerServer(dir string) *controllerServer {
+	store = newVolumeStore()
+	d := csicommon.NewCSIDriver("hostpath.test", vendorVersion, "node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+	})
+	return NewControllerServer(d, capacityModeNone, map[string]string{defaultPool: dir}, nil)
+}
+
+func createMountVolume(t *testing.T, cs *controllerServer, name string, source *csi.VolumeContentSource) (*csi.Volume, error) {
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: name,
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		VolumeContentSource: source,
+	})
+	return resp.GetVolume(), err
+}
+
+func TestPaginate(t *testing.T) {
+	// Test everything in one page
+	start, end, next, err := paginate(5, 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, start)
+	assert.Equal(t, 5, end)
+	assert.Equal(t, "", next)
+
+	// Test first and last page
+	start, end, next, err = paginate(5, 2, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, start)
+	assert.Equal(t, 2, end)
+	assert.Equal(t, "2", next)
+
+	start, end, next, err = paginate(5, 2, "4")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, start)
+	assert.Equal(t, 5, end)
+	assert.Equal(t, "", next)
+
+	// Test invalid starting token
+	_, _, _, err = paginate(5, 2, "6")
+	s, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.Aborted, s.Code())
+
+	_, _, _, err = paginate(5, 2, "bogus")
+	s, ok = status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.Aborted, s.Code())
+}
+
+func TestCloneVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostpath-clone")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0750))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "sub", "file"), []byte("data"), 0640))
+	assert.NoError(t, os.Symlink("sub/file", filepath.Join(src, "link")))
+	assert.NoError(t, os.Mkdir(dst, 0750))
+
+	assert.NoError(t, cloneVolume(hostPathVolume{VolID: "src", VolPath: src}, dst))
+	data, err := ioutil.ReadFile(filepath.Join(dst, "sub", "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	fi, err := os.Stat(filepath.Join(dst, "sub", "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+	link, err := os.Readlink(filepath.Join(dst, "link"))
+	assert.NoError(t, err)
+	assert.Equal(t, "sub/file", link)
+}
+
+func TestSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostpath-snapshot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(s *volumeStore) { store = s }(store)
+	cs := newSnapshotControllerServer(dir)
+
+	vol, err := createMountVolume(t, cs, "vol", nil)
+	assert.NoError(t, err)
+	var ids []string
+	for _, name := range []string{"snap-a", "snap-b", "snap-c"} {
+		resp, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: name, SourceVolumeId: vol.GetId()})
+		assert.NoError(t, err)
+		assert.Equal(t, vol.GetId(), resp.GetSnapshot().GetSourceVolumeId())
+		assert.Equal(t, csi.SnapshotStatus_READY, resp.GetSnapshot().GetStatus().GetType())
+		ids = append(ids, resp.GetSnapshot().GetId())
+	}
+
+	// Test that creating a snapshot again returns the existing one
+	resp, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap-a", SourceVolumeId: vol.GetId()})
+	assert.NoError(t, err)
+	assert.Equal(t, ids[0], resp.GetSnapshot().GetId())
+	_, err = cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap-a", SourceVolumeId: "other"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap-d", SourceVolumeId: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// Test listing all snapshots in pages
+	var listed []string
+	token := ""
+	for i := 0; i < 2; i++ {
+		list, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: 2, StartingToken: token})
+		assert.NoError(t, err)
+		for _, entry := range list.GetEntries() {
+			listed = append(listed, entry.GetSnapshot().GetId())
+		}
+		token = list.GetNextToken()
+	}
+	assert.Equal(t, "", token)
+	assert.ElementsMatch(t, ids, listed)
+
+	// Test filtering by snapshot and source volume
+	list, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: ids[1]})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(list.GetEntries()))
+	assert.Equal(t, ids[1], list.GetEntries()[0].GetSnapshot().GetId())
+	list, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SourceVolumeId: "other"})
+	assert.NoError(t, err)
+	assert.Empty(t, list.GetEntries())
+
+	// Test that deleting removes the archive and is idempotent
+	snapshot, err := store.getSnapshotByID(ids[0])
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: ids[0]})
+		assert.NoError(t, err)
+	}
+	_, err = os.Stat(snapshot.Path)
+	assert.True(t, os.IsNotExist(err))
+	list, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(list.GetEntries()))
+}
+
+func TestCreateVolumeFromSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostpath-snapshot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(s *volumeStore) { store = s }(store)
+	cs := newSnapshotControllerServer(dir)
+
+	src, err := createMountVolume(t, cs, "src", nil)
+	assert.NoError(t, err)
+	srcPath := filepath.Join(dir, src.GetId())
+	assert.NoError(t, os.MkdirAll(filepath.Join(srcPath, "sub"), 0750))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(srcPath, "sub", "file"), []byte("data"), 0640))
+	resp, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: src.GetId()})
+	assert.NoError(t, err)
+
+	// Test that changes after the snapshot are not restored
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(srcPath, "sub", "file"), []byte("changed"), 0640))
+
+	source := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{Id: resp.GetSnapshot().GetId()},
+		},
+	}
+	vol, err := createMountVolume(t, cs, "restored", source)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.GetSnapshot().GetId(), vol.GetContentSource().GetSnapshot().GetId())
+	data, err := ioutil.ReadFile(filepath.Join(dir, vol.GetId(), "sub", "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	// Test that a restored volume cannot change its source
+	_, err = createMountVolume(t, cs, "restored", nil)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	source.GetSnapshot().Id = "missing"
+	_, err = createMountVolume(t, cs, "missing", source)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	// ephemeralAttribute marks an inline volume which only lives as long as
+	// it is published, e.g. a scratch volume of a CI pod.
+	ephemeralAttribute = "csi.storage.k8s.io/ephemeral"
+	// ephemeralDir is the directory of the default pool ephemeral volumes
+	// are created in.
+	ephemeralDir = "ephemeral"
+	// targetFileSuffix names the file next to an ephemeral volume directory
+	// which records the target path the volume is published at.
+	targetFileSuffix = ".target"
+)
+
+func isEphemeral(attributes map[string]string) bool {
+	return attributes[ephemeralAttribute] == "true"
+}
+
+// validEphemeralID makes sure a volume ID chosen by the CO can be used as a
+// directory name.
+func validEphemeralID(volumeID string) error {
+	if volumeID == "." || volumeID == ".." || strings.ContainsRune(volumeID, '/') {
+		return fmt.Errorf("hostpath: invalid ephemeral volume id %q", volumeID)
+	}
+	return nil
+}
+
+// createEphemeralVolume creates the directory of an ephemeral volume, if it
+// does not exist yet, and records its target path. The directory is created
+// before the record, so a directory without a record is always an orphan.
+func createEphemeralVolume(root, volumeID, targetPath string) (string, error) {
+	if err := validEphemeralID(volumeID); err != nil {
+		return "", err
+	}
+	path := filepath.Join(root, volumeID)
+	if err := os.MkdirAll(path, 0750); err != nil {
+		return "", fmt.Errorf("hostpath: failed to create ephemeral volume %s: %v", path, err)
+	}
+	if err := ioutil.WriteFile(path+targetFileSuffix, []byte(targetPath), 0640); err != nil {
+		return "", fmt.Errorf("hostpath: failed to record target of ephemeral volume %s: %v", path, err)
+	}
+	return path, nil
+}
+
+// ephemeralVolumeExists reports whether volumeID is an ephemeral volume
+// created by createEphemeralVolume.
+func ephemeralVolumeExists(root, volumeID string) bool {
+	if validEphemeralID(volumeID) != nil {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(root, volumeID))
+	return err == nil && fi.IsDir()
+}
+
+// removeEphemeralVolume removes the directory of an ephemeral volume and its
+// target record.
+func removeEphemeralVolume(root, volumeID string) error {
+	path := filepath.Join(root, volumeID)
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("hostpath: failed to remove ephemeral volume %s: %v", path, err)
+	}
+	if err := os.Remove(path + targetFileSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// sweepEphemeralVolumes removes the ephemeral volumes left behind when the
+// plugin crashed before NodeUnpublishVolume, i.e. the volumes which have no
+// target record or whose target is not mounted anymore.
+func sweepEphemeralVolumes(root string) error {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("hostpath: failed to read %s: %v", root, err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		path := filepath.Join(root, e.Name())
+		if !isOrphanedEphemeralVolume(path) {
+			continue
+		}
+		glog.Warningf("hostpath: removing orphaned ephemeral volume %s", path)
+		if err := removeEphemeralVolume(root, e.Name()); err != nil {
+			glog.Errorf("hostpath: %v", err)
+		}
+	}
+	return nil
+}
+
+func isOrphanedEphemeralVolume(path string) bool {
+	target, err := ioutil.ReadFile(path + targetFileSuffix)
+	if err != nil {
+		return true
+	}
+	if _, err := os.Stat(string(target)); err != nil {
+		return true
+	}
+	// The target is a bind mount, possibly within one filesystem
+	notMnt, err := mount.IsNotMountPoint(mount.New(""), string(target))
+	if err != nil {
+		glog.Warningf("hostpath: failed to check target %s of ephemeral volume %s: %v", string(target), path, err)
+		return false
+	}
+	return notMnt
+}
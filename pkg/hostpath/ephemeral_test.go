@@ -0,0 +1,74 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsEphemeral(t *testing.T) {
+	assert.True(t, isEphemeral(map[string]string{ephemeralAttribute: "true"}))
+	assert.False(t, isEphemeral(map[string]string{ephemeralAttribute: "false"}))
+	assert.False(t, isEphemeral(nil))
+}
+
+func TestEphemeralVolumeLifecycle(t *testing.T) {
+	root, err := ioutil.TempDir("", "hostpath-ephemeral")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	_, err = createEphemeralVolume(root, "../escape", "/target")
+	assert.Error(t, err)
+	assert.False(t, ephemeralVolumeExists(root, ".."))
+
+	path, err := createEphemeralVolume(root, "csi-1234", "/target")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "csi-1234"), path)
+	assert.True(t, ephemeralVolumeExists(root, "csi-1234"))
+	target, err := ioutil.ReadFile(path + targetFileSuffix)
+	assert.NoError(t, err)
+	assert.Equal(t, "/target", string(target))
+
+	assert.NoError(t, removeEphemeralVolume(root, "csi-1234"))
+	assert.False(t, ephemeralVolumeExists(root, "csi-1234"))
+	_, err = os.Stat(path + targetFileSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSweepEphemeralVolumes(t *testing.T) {
+	root, err := ioutil.TempDir("", "hostpath-ephemeral")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	// Test a missing root
+	assert.NoError(t, sweepEphemeralVolumes(filepath.Join(root, "missing")))
+
+	// A volume whose target is gone and one which was never recorded
+	_, err = createEphemeralVolume(root, "gone", filepath.Join(root, "no-such-target"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "unrecorded"), 0750))
+
+	assert.NoError(t, sweepEphemeralVolumes(root))
+	entries, err := ioutil.ReadDir(root)
+	assert.NoError(t, err)
+	assert.Zero(t, len(entries))
+}
@@ -17,7 +17,8 @@ limitations under the License.
 package hostpath
 
 import (
-	"fmt"
+	"os"
+	"path/filepath"
 
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/golang/glog"
@@ -34,6 +35,12 @@ const (
 	tib100 int64 = tib * 100
 )
 
+// Volume access types
+const (
+	mountAccess = "mount"
+	blockAccess = "block"
+)
+
 type hostPath struct {
 	driver *csicommon.CSIDriver
 
@@ -50,74 +57,147 @@ type hostPathVolume struct {
 	VolID   string `json:"volID"`
 	VolSize int64  `json:"volSize"`
 	VolPath string `json:"volPath"`
+	// VolAccessType is mountAccess for a directory and blockAccess for a
+	// sparse file which is attached to a loop device.
+	VolAccessType string `json:"volAccessType"`
+	// VolPool is the name of the pool the volume was provisioned in.
+	VolPool string `json:"volPool,omitempty"`
+	// The volume or snapshot the volume was created from, if any.
+	VolSourceVolumeID   string `json:"volSourceVolumeID,omitempty"`
+	VolSourceSnapshotID string `json:"volSourceSnapshotID,omitempty"`
+	// VolTopology holds the segments of the node the volume was created on.
+	VolTopology map[string]string `json:"volTopology,omitempty"`
+
+	// Capacity enforcement, see capacity.go
+	VolBacking   string `json:"volBacking,omitempty"`
+	VolImage     string `json:"volImage,omitempty"`
+	VolProjectID uint32 `json:"volProjectID,omitempty"`
+
+	// Node state, see nodeserver.go
+	VolStagingPath string   `json:"volStagingPath,omitempty"`
+	VolTargets     []string `json:"volTargets,omitempty"`
+}
+
+type hostPathSnapshot struct {
+	Name         string `json:"name"`
+	Id           string `json:"id"`
+	VolID        string `json:"volID"`
+	Path         string `json:"path"`
+	CreationTime int64  `json:"creationTime"`
+	SizeBytes    int64  `json:"sizeBytes"`
+	ReadyToUse   bool   `json:"readyToUse"`
 }
 
-var hostPathVolumes map[string]hostPathVolume
+// store holds the volumes and snapshots of the driver
+var store = newVolumeStore()
 
 var (
 	hostPathDriver *hostPath
 	vendorVersion  = "0.2.0"
 )
 
-func init() {
-	hostPathVolumes = map[string]hostPathVolume{}
-}
-
 func GetHostPathDriver() *hostPath {
 	return &hostPath{}
 }
 
-func NewIdentityServer(d *csicommon.CSIDriver) *identityServer {
+func NewIdentityServer(d *csicommon.CSIDriver, topology map[string]string) *identityServer {
 	return &identityServer{
 		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d),
+		topology:              topology,
 	}
 }
 
-func NewControllerServer(d *csicommon.CSIDriver) *controllerServer {
+func NewControllerServer(d *csicommon.CSIDriver, capacityMode string, pools, topology map[string]string) *controllerServer {
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		capacityMode:            capacityMode,
+		pools:                   pools,
+		topology:                topology,
 	}
 }
 
-func NewNodeServer(d *csicommon.CSIDriver) *nodeServer {
+func NewNodeServer(d *csicommon.CSIDriver, ephemeralRoot string, topology map[string]string) *nodeServer {
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
+		ephemeralRoot:     ephemeralRoot,
+		topology:          topology,
 	}
 }
 
-func (hp *hostPath) Run(driverName, nodeID, endpoint string) {
+func (hp *hostPath) Run(driverName, nodeID, endpoint, stateDir, capacityMode string, pools, topology map[string]string) {
 	glog.Infof("Driver: %v ", driverName)
 
+	for name, root := range pools {
+		if err := os.MkdirAll(root, 0755); err != nil {
+			glog.Fatalf("Failed to create pool %q at %s: %v", name, root, err)
+		}
+		if err := validateCapacityMode(capacityMode, root); err != nil {
+			glog.Fatalln(err)
+		}
+	}
+
+	// Restore the volumes and snapshots known before the last restart
+	if err := loadVolumes(stateDir, pools); err != nil {
+		glog.Fatalln(err)
+	}
+	// Remove ephemeral volumes left behind by a crash
+	ephemeralRoot := filepath.Join(pools[defaultPool], ephemeralDir)
+	if err := sweepEphemeralVolumes(ephemeralRoot); err != nil {
+		glog.Errorln(err)
+	}
+
 	// Initialize default library driver
 	hp.driver = csicommon.NewCSIDriver(driverName, vendorVersion, nodeID)
 	if hp.driver == nil {
 		glog.Fatalln("Failed to initialize CSI Driver.")
 	}
-	hp.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
+	hp.driver.AddControllerServiceCapabilities(
+		[]csi.ControllerServiceCapability_RPC_Type{
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		})
 	hp.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 
 	// Create GRPC servers
-	hp.ids = NewIdentityServer(hp.driver)
-	hp.ns = NewNodeServer(hp.driver)
-	hp.cs = NewControllerServer(hp.driver)
+	hp.ids = NewIdentityServer(hp.driver, topology)
+	hp.ns = NewNodeServer(hp.driver, ephemeralRoot, topology)
+	hp.cs = NewControllerServer(hp.driver, capacityMode, pools, topology)
 
 	s := csicommon.NewNonBlockingGRPCServer()
 	s.Start(endpoint, hp.ids, hp.cs, hp.ns)
 	s.Wait()
 }
 
-func getVolumeByID(volumeID string) (hostPathVolume, error) {
-	if hostPathVol, ok := hostPathVolumes[volumeID]; ok {
-		return hostPathVol, nil
+func loadVolumes(stateDir string, pools map[string]string) error {
+	c, err := newVolumeCatalog(stateDir)
+	if err != nil {
+		return err
 	}
-	return hostPathVolume{}, fmt.Errorf("volume id %s does not exit in the volumes list", volumeID)
-}
-
-func getVolumeByName(volName string) (hostPathVolume, error) {
-	for _, hostPathVol := range hostPathVolumes {
-		if hostPathVol.VolName == volName {
-			return hostPathVol, nil
+	vols, err := c.loadVolumes()
+	if err != nil {
+		return err
+	}
+	snaps, err := c.loadSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, root := range pools {
+		reconcileVolumes(vols, root)
+	}
+	reconcileSnapshots(snaps)
+	for id, vol := range vols {
+		// Volumes created before block support are directories
+		if vol.VolAccessType == "" {
+			vol.VolAccessType = mountAccess
+			vols[id] = vol
+		}
+		if err := restoreVolumeBacking(vol); err != nil {
+			glog.Errorf("hostpath: failed to restore backing of volume %s: %v", vol.VolID, err)
 		}
 	}
-	return hostPathVolume{}, fmt.Errorf("volume name %s does not exit in the volumes list", volName)
+	glog.V(4).Infof("hostpath: loaded %d volumes and %d snapshots from %s", len(vols), len(snaps), stateDir)
+	return store.load(c, vols, snaps)
 }
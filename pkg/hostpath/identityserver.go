@@ -17,9 +17,32 @@ limitations under the License.
 package hostpath
 
 import (
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"golang.org/x/net/context"
+
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
 type identityServer struct {
 	*csicommon.DefaultIdentityServer
+	// topology holds the segments of the node
+	topology map[string]string
+}
+
+func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	resp, err := ids.DefaultIdentityServer.GetPluginCapabilities(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	// Volumes are only accessible from the node they were created on
+	if len(ids.topology) != 0 {
+		resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		})
+	}
+	return resp, nil
 }
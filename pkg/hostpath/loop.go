@@ -0,0 +1,83 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// attachLoopDevice attaches file to the first free loop device and returns
+// the device path.
+func attachLoopDevice(file string) (string, error) {
+	out, err := exec.Command("losetup", "-f", "--show", file).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("hostpath: failed to attach loop device for %s: %v: %s", file, err, string(out))
+	}
+	device := strings.TrimSpace(string(out))
+	glog.V(4).Infof("hostpath: attached %s to %s", file, device)
+	return device, nil
+}
+
+// findLoopDevice returns the loop device file is attached to, or an empty
+// string if it is not attached.
+func findLoopDevice(file string) (string, error) {
+	out, err := exec.Command("losetup", "-j", file).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("hostpath: failed to look up loop device for %s: %v: %s", file, err, string(out))
+	}
+	return parseLosetupAssociation(string(out)), nil
+}
+
+// getOrAttachLoopDevice returns the loop device of file, attaching one if
+// necessary, e.g. after a node reboot.
+func getOrAttachLoopDevice(file string) (string, error) {
+	device, err := findLoopDevice(file)
+	if err != nil {
+		return "", err
+	}
+	if device != "" {
+		return device, nil
+	}
+	return attachLoopDevice(file)
+}
+
+// detachLoopDevice detaches the loop device file is attached to, if any.
+func detachLoopDevice(file string) error {
+	device, err := findLoopDevice(file)
+	if err != nil || device == "" {
+		return err
+	}
+	if out, err := exec.Command("losetup", "-d", device).CombinedOutput(); err != nil {
+		return fmt.Errorf("hostpath: failed to detach %s: %v: %s", device, err, string(out))
+	}
+	glog.V(4).Infof("hostpath: detached %s from %s", file, device)
+	return nil
+}
+
+// parseLosetupAssociation extracts the device from the first line of
+// "losetup -j" output, e.g. "/dev/loop0: [2049]:1234 (/tmp/file)".
+func parseLosetupAssociation(output string) string {
+	line := strings.TrimSpace(strings.SplitN(output, "\n", 2)[0])
+	if line == "" {
+		return ""
+	}
+	return strings.SplitN(line, ":", 2)[0]
+}
@@ -0,0 +1,33 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLosetupAssociation(t *testing.T) {
+	// Test not attached
+	assert.Equal(t, "", parseLosetupAssociation(""))
+	assert.Equal(t, "", parseLosetupAssociation("\n"))
+
+	// Test attached, possibly more than once
+	assert.Equal(t, "/dev/loop0", parseLosetupAssociation("/dev/loop0: [2049]:1234 (/tmp/vol)\n"))
+	assert.Equal(t, "/dev/loop3", parseLosetupAssociation("/dev/loop3: [2049]:1234 (/tmp/vol)\n/dev/loop4: [2049]:1234 (/tmp/vol)\n"))
+}
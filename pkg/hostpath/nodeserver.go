@@ -18,6 +18,7 @@ package hostpath
 
 import (
 	"os"
+	"path/filepath"
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
@@ -30,8 +31,20 @@ import (
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
+// The node server publishes volumes in two phases. NodeStageVolume bind
+// mounts the volume directory, or the loop device of a block volume, into
+// the staging path once. NodePublishVolume bind mounts the staged volume on
+// each target path. The staging path and the targets are recorded with the
+// volume, so that NodeUnstageVolume can refuse to unstage a volume which is
+// still published.
+//
+// Ephemeral inline volumes skip staging, see ephemeral.go.
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	// ephemeralRoot is the directory ephemeral volumes are created in
+	ephemeralRoot string
+	// topology holds the segments of the node
+	topology map[string]string
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
@@ -46,49 +59,53 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if len(req.GetTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
+	if isEphemeral(req.GetVolumeAttributes()) {
+		return ns.publishEphemeralVolume(req)
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
 
 	targetPath := req.GetTargetPath()
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			if err = os.MkdirAll(targetPath, 0750); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-			notMnt = true
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
-		}
+	volumeID := req.GetVolumeId()
+	if !store.tryLock(nodeVolumeKey(volumeID)) {
+		return nil, status.Errorf(codes.Aborted, "An operation for volume %s is already in progress", volumeID)
 	}
+	defer store.unlock(nodeVolumeKey(volumeID))
 
-	if !notMnt {
-		return &csi.NodePublishVolumeResponse{}, nil
+	hostPathVol, err := store.getVolumeByID(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
 	}
-
-	fsType := req.GetVolumeCapability().GetMount().GetFsType()
-
-	deviceId := ""
-	if req.GetPublishInfo() != nil {
-		deviceId = req.GetPublishInfo()[deviceID]
+	if err := checkAccessType(hostPathVol, req.GetVolumeCapability()); err != nil {
+		return nil, err
+	}
+	if hostPathVol.VolStagingPath != req.GetStagingTargetPath() {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is not staged at %s", volumeID, req.GetStagingTargetPath())
 	}
 
-	readOnly := req.GetReadonly()
-	volumeId := req.GetVolumeId()
-	attrib := req.GetVolumeAttributes()
-	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
-
-	glog.V(4).Infof("target %v\nfstype %v\ndevice %v\nreadonly %v\nattributes %v\n mountflags %v\n",
-		targetPath, fsType, deviceId, readOnly, volumeId, attrib, mountFlags)
+	glog.V(4).Infof("target %v\nstaging path %v\nreadonly %v\nattributes %v\nmountflags %v\n",
+		targetPath, hostPathVol.VolStagingPath, req.GetReadonly(), req.GetVolumeAttributes(),
+		req.GetVolumeCapability().GetMount().GetMountFlags())
 
-	options := []string{"bind"}
-	if readOnly {
-		options = append(options, "ro")
+	if err := makeMountTarget(targetPath, hostPathVol.VolAccessType); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
-	mounter := mount.New("")
-	path := provisionRoot + volumeId
-	if err := mounter.Mount(path, targetPath, "", options); err != nil {
-		return nil, err
+	if err := bindMount(getStagedPath(hostPathVol), targetPath, req.GetReadonly()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	err = store.updateVolume(volumeID, func(vol *hostPathVolume) {
+		for _, t := range vol.VolTargets {
+			if t == targetPath {
+				return
+			}
+		}
+		vol.VolTargets = append(vol.VolTargets, targetPath)
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -103,12 +120,35 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	}
 	targetPath := req.GetTargetPath()
 	volumeID := req.GetVolumeId()
+	if !store.tryLock(nodeVolumeKey(volumeID)) {
+		return nil, status.Errorf(codes.Aborted, "An operation for volume %s is already in progress", volumeID)
+	}
+	defer store.unlock(nodeVolumeKey(volumeID))
 
-	// Unmounting the image
-	err := mount.New("").Unmount(req.GetTargetPath())
-	if err != nil {
+	if err := unmountTarget(targetPath); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	if ephemeralVolumeExists(ns.ephemeralRoot, volumeID) {
+		if err := removeEphemeralVolume(ns.ephemeralRoot, volumeID); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.V(4).Infof("hostpath: ephemeral volume %s/%s has been removed.", targetPath, volumeID)
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+	err := store.updateVolume(volumeID, func(vol *hostPathVolume) {
+		var targets []string
+		for _, t := range vol.VolTargets {
+			if t != targetPath {
+				targets = append(targets, t)
+			}
+		}
+		vol.VolTargets = targets
+	})
+	if err != nil {
+		// The volume may have been deleted meanwhile, there is nothing to
+		// record then
+		glog.V(4).Infof("hostpath: not recording unpublish of volume %s: %v", volumeID, err)
+	}
 	glog.V(4).Infof("hostpath: volume %s/%s has been unmounted.", targetPath, volumeID)
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
@@ -123,7 +163,55 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	if len(req.GetStagingTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	volumeID := req.GetVolumeId()
+	if !store.tryLock(nodeVolumeKey(volumeID)) {
+		return nil, status.Errorf(codes.Aborted, "An operation for volume %s is already in progress", volumeID)
+	}
+	defer store.unlock(nodeVolumeKey(volumeID))
+
+	hostPathVol, err := store.getVolumeByID(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err := checkAccessType(hostPathVol, req.GetVolumeCapability()); err != nil {
+		return nil, err
+	}
+	if len(hostPathVol.VolStagingPath) != 0 && hostPathVol.VolStagingPath != stagingPath {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is already staged at %s", volumeID, hostPathVol.VolStagingPath)
+	}
+
+	source := hostPathVol.VolPath
+	if hostPathVol.VolAccessType == blockAccess {
+		source, err = getOrAttachLoopDevice(hostPathVol.VolPath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	hostPathVol.VolStagingPath = stagingPath
+	stagedPath := getStagedPath(hostPathVol)
+	if err := os.MkdirAll(stagingPath, 0750); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := makeMountTarget(stagedPath, hostPathVol.VolAccessType); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.V(4).Infof("hostpath: staging volume %s from %s at %s", volumeID, source, stagedPath)
+	if err := bindMount(source, stagedPath, false); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
+	err = store.updateVolume(volumeID, func(vol *hostPathVolume) {
+		vol.VolStagingPath = stagingPath
+	})
+	if err != nil {
+		unmountTarget(stagedPath)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
@@ -137,5 +225,171 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	stagingPath := req.GetStagingTargetPath()
+	volumeID := req.GetVolumeId()
+	if !store.tryLock(nodeVolumeKey(volumeID)) {
+		return nil, status.Errorf(codes.Aborted, "An operation for volume %s is already in progress", volumeID)
+	}
+	defer store.unlock(nodeVolumeKey(volumeID))
+
+	hostPathVol, err := store.getVolumeByID(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if hostPathVol.VolStagingPath != stagingPath {
+		// Not staged, or already unstaged
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+	if len(hostPathVol.VolTargets) != 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is still published at %v", volumeID, hostPathVol.VolTargets)
+	}
+
+	if err := unmountTarget(getStagedPath(hostPathVol)); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	err = store.updateVolume(volumeID, func(vol *hostPathVolume) {
+		vol.VolStagingPath = ""
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.V(4).Infof("hostpath: volume %s has been unstaged from %s", volumeID, stagingPath)
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
+
+func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	resp, err := ns.DefaultNodeServer.NodeGetInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(ns.topology) != 0 {
+		resp.AccessibleTopology = &csi.Topology{Segments: ns.topology}
+	}
+	return resp, nil
+}
+
+// publishEphemeralVolume creates a fresh directory for an ephemeral volume on
+// first publish and bind mounts it on the target path.
+func (ns *nodeServer) publishEphemeralVolume(req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+	volumeID := req.GetVolumeId()
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "Ephemeral volumes do not support block access")
+	}
+	if !store.tryLock(nodeVolumeKey(volumeID)) {
+		return nil, status.Errorf(codes.Aborted, "An operation for volume %s is already in progress", volumeID)
+	}
+	defer store.unlock(nodeVolumeKey(volumeID))
+
+	if _, err := store.getVolumeByID(volumeID); err == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume %s is not an ephemeral volume", volumeID)
+	}
+	if err := validEphemeralID(volumeID); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	path, err := createEphemeralVolume(ns.ephemeralRoot, volumeID, targetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.V(4).Infof("hostpath: publishing ephemeral volume %s at %s", path, targetPath)
+	if err := makeMountTarget(targetPath, mountAccess); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := bindMount(path, targetPath, req.GetReadonly()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// checkAccessType makes sure the requested access type matches the volume.
+func checkAccessType(vol hostPathVolume, cap *csi.VolumeCapability) error {
+	if cap.GetBlock() != nil && vol.VolAccessType != blockAccess {
+		return status.Errorf(codes.InvalidArgument, "Volume %s is not a block volume", vol.VolID)
+	}
+	if cap.GetMount() != nil && vol.VolAccessType == blockAccess {
+		return status.Errorf(codes.InvalidArgument, "Block volume %s cannot be mounted", vol.VolID)
+	}
+	return nil
+}
+
+// getStagedPath returns where a staged volume is mounted. Block volumes are
+// staged on a file in the staging directory named after the volume.
+func getStagedPath(vol hostPathVolume) string {
+	if vol.VolAccessType == blockAccess {
+		return filepath.Join(vol.VolStagingPath, vol.VolID)
+	}
+	return vol.VolStagingPath
+}
+
+// makeMountTarget creates the directory, or for block volumes the file, a
+// volume is bind mounted on.
+func makeMountTarget(path, accessType string) error {
+	if accessType != blockAccess {
+		return os.MkdirAll(path, 0750)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(path, os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+// bindMount bind mounts source on target unless target is already a mount
+// point. Bind mounts within one filesystem share the device of their parent,
+// so the mount table is checked rather than the device.
+func bindMount(source, target string, readOnly bool) error {
+	mounter := mount.New("")
+	notMnt, err := mount.IsNotMountPoint(mounter, target)
+	if err != nil {
+		return err
+	}
+	if !notMnt {
+		return nil
+	}
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	return mounter.Mount(source, target, "", options)
+}
+
+// unmountTarget unmounts target if it is a mount point and removes it if it
+// is a file. A missing target is not an error.
+func unmountTarget(target string) error {
+	mounter := mount.New("")
+	notMnt, err := mount.IsNotMountPoint(mounter, target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !notMnt {
+		if err := mounter.Unmount(target); err != nil {
+			return err
+		}
+	}
+	// Block volumes are mounted on a file, remove it
+	if fi, err := os.Stat(target); err == nil && !fi.IsDir() {
+		return os.Remove(target)
+	}
+	return nil
+}
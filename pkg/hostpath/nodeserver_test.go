@@ -0,0 +1,84 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+func TestNodeGetCapabilities(t *testing.T) {
+	ns := NewNodeServer(csicommon.NewCSIDriver("hostpath.test", vendorVersion, "node"), "/nonexistent", nil)
+	resp, err := ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(resp.GetCapabilities()))
+	assert.Equal(t, csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME, resp.GetCapabilities()[0].GetRpc().GetType())
+}
+
+func TestNodeStagePreconditions(t *testing.T) {
+	ns := NewNodeServer(csicommon.NewCSIDriver("hostpath.test", vendorVersion, "node"), "/nonexistent", nil)
+	vol := hostPathVolume{
+		VolName:        "staged",
+		VolID:          "staged-id",
+		VolAccessType:  mountAccess,
+		VolStagingPath: "/staging",
+		VolTargets:     []string{"/target"},
+	}
+	assert.NoError(t, store.addVolume(vol))
+	defer store.deleteVolume(vol.VolID)
+	mountCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}
+
+	// Test publishing from a different staging path
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          vol.VolID,
+		StagingTargetPath: "/other",
+		TargetPath:        "/target2",
+		VolumeCapability:  mountCap,
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Test staging at a second staging path
+	_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          vol.VolID,
+		StagingTargetPath: "/other",
+		VolumeCapability:  mountCap,
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Test unstaging a volume which is still published
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          vol.VolID,
+		StagingTargetPath: "/staging",
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Test unstaging from a path the volume is not staged at
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          vol.VolID,
+		StagingTargetPath: "/other",
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// defaultPool is the pool used when a StorageClass does not set
+	// poolParameter, it is located at the provision root.
+	defaultPool = ""
+	// poolParameter selects the pool a volume is provisioned in.
+	poolParameter = "pool"
+)
+
+// ParsePools returns the map of pool names to directories described by spec,
+// a comma separated list of name=directory pairs. The default pool is always
+// part of the map and located at provisionRoot.
+func ParsePools(provisionRoot, spec string) (map[string]string, error) {
+	if provisionRoot == "" {
+		return nil, fmt.Errorf("hostpath: provision root missing")
+	}
+	pools := map[string]string{
+		defaultPool: filepath.Clean(provisionRoot),
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("hostpath: invalid pool %q, expected name=directory", entry)
+		}
+		if _, ok := pools[kv[0]]; ok {
+			return nil, fmt.Errorf("hostpath: duplicate pool %q", kv[0])
+		}
+		pools[kv[0]] = filepath.Clean(kv[1])
+	}
+	return pools, nil
+}
+
+// getAvailableCapacity returns the number of bytes available to unprivileged
+// users on the filesystem holding root.
+func getAvailableCapacity(root string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(root, &st); err != nil {
+		return 0, fmt.Errorf("hostpath: failed to statfs %s: %v", root, err)
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePools(t *testing.T) {
+	// Test default pool only
+	pools, err := ParsePools("/tmp/", "")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{defaultPool: "/tmp"}, pools)
+
+	// Test additional pools
+	pools, err = ParsePools("/tmp", "fast=/mnt/ssd/, slow=/mnt/hdd")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		defaultPool: "/tmp",
+		"fast":      "/mnt/ssd",
+		"slow":      "/mnt/hdd",
+	}, pools)
+
+	// Test invalid arguments
+	_, err = ParsePools("", "")
+	assert.Error(t, err)
+	_, err = ParsePools("/tmp", "fast")
+	assert.Error(t, err)
+	_, err = ParsePools("/tmp", "=/mnt/ssd")
+	assert.Error(t, err)
+	_, err = ParsePools("/tmp", "fast=/mnt/ssd,fast=/mnt/hdd")
+	assert.Error(t, err)
+}
+
+func TestGetAvailableCapacity(t *testing.T) {
+	available, err := getAvailableCapacity(os.TempDir())
+	assert.NoError(t, err)
+	assert.True(t, available >= 0)
+
+	_, err = getAvailableCapacity("/does/not/exist")
+	assert.Error(t, err)
+}
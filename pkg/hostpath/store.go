@@ -0,0 +1,285 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// volumeStore holds the volumes and snapshots of the driver and persists them
+// to the catalog, if any. All methods are safe for concurrent use.
+//
+// Besides guarding the lists, the store hands out operation locks keyed by
+// volume or snapshot name and ID. gRPC handlers which create or delete an
+// object take its locks with tryLock first, so that a second request for the
+// same object fails with Aborted instead of racing with the first one.
+type volumeStore struct {
+	mu            sync.RWMutex
+	volumes       map[string]hostPathVolume
+	snapshots     map[string]hostPathSnapshot
+	catalog       *volumeCatalog
+	lastProjectID uint32
+
+	opsMu sync.Mutex
+	ops   map[string]bool
+}
+
+func newVolumeStore() *volumeStore {
+	return &volumeStore{
+		volumes:   map[string]hostPathVolume{},
+		snapshots: map[string]hostPathSnapshot{},
+		ops:       map[string]bool{},
+	}
+}
+
+// Operation lock keys
+func volumeNameKey(name string) string   { return "volume-name/" + name }
+func volumeIDKey(id string) string       { return "volume-id/" + id }
+func nodeVolumeKey(id string) string     { return "node-volume/" + id }
+func snapshotNameKey(name string) string { return "snapshot-name/" + name }
+func snapshotIDKey(id string) string     { return "snapshot-id/" + id }
+
+// tryLock takes the operation locks for all keys. It takes none of them and
+// returns false if any of them is already held.
+func (s *volumeStore) tryLock(keys ...string) bool {
+	s.opsMu.Lock()
+	defer s.opsMu.Unlock()
+	for _, key := range keys {
+		if s.ops[key] {
+			return false
+		}
+	}
+	for _, key := range keys {
+		s.ops[key] = true
+	}
+	return true
+}
+
+// unlock releases the operation locks taken by tryLock.
+func (s *volumeStore) unlock(keys ...string) {
+	s.opsMu.Lock()
+	defer s.opsMu.Unlock()
+	for _, key := range keys {
+		delete(s.ops, key)
+	}
+}
+
+// load replaces the content of the store and starts persisting it to c.
+func (s *volumeStore) load(c *volumeCatalog, vols map[string]hostPathVolume, snaps map[string]hostPathSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.catalog = c
+	s.volumes = vols
+	s.snapshots = snaps
+	if err := s.persistVolumes(); err != nil {
+		return err
+	}
+	return s.persistSnapshots()
+}
+
+func (s *volumeStore) getVolumeByID(volumeID string) (hostPathVolume, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if hostPathVol, ok := s.volumes[volumeID]; ok {
+		return hostPathVol, nil
+	}
+	return hostPathVolume{}, fmt.Errorf("volume id %s does not exit in the volumes list", volumeID)
+}
+
+func (s *volumeStore) getVolumeByName(volName string) (hostPathVolume, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, hostPathVol := range s.volumes {
+		if hostPathVol.VolName == volName {
+			return hostPathVol, nil
+		}
+	}
+	return hostPathVolume{}, fmt.Errorf("volume name %s does not exit in the volumes list", volName)
+}
+
+// listVolumes returns all volumes sorted by ID.
+func (s *volumeStore) listVolumes() []hostPathVolume {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var volumes []hostPathVolume
+	for _, vol := range s.volumes {
+		volumes = append(volumes, vol)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].VolID < volumes[j].VolID
+	})
+	return volumes
+}
+
+// addVolume adds or replaces a volume. The store is left unchanged if the
+// volume cannot be persisted.
+func (s *volumeStore) addVolume(vol hostPathVolume) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, existed := s.volumes[vol.VolID]
+	s.volumes[vol.VolID] = vol
+	if err := s.persistVolumes(); err != nil {
+		if existed {
+			s.volumes[vol.VolID] = old
+		} else {
+			delete(s.volumes, vol.VolID)
+		}
+		return err
+	}
+	return nil
+}
+
+// updateVolume applies update to the volume volumeID and stores the result.
+// The store is left unchanged if the volume cannot be persisted.
+func (s *volumeStore) updateVolume(volumeID string, update func(vol *hostPathVolume)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.volumes[volumeID]
+	if !ok {
+		return fmt.Errorf("volume id %s does not exit in the volumes list", volumeID)
+	}
+	vol := old
+	vol.VolTargets = append([]string(nil), old.VolTargets...)
+	update(&vol)
+	s.volumes[volumeID] = vol
+	if err := s.persistVolumes(); err != nil {
+		s.volumes[volumeID] = old
+		return err
+	}
+	return nil
+}
+
+// deleteVolume removes a volume, removing an unknown volume is not an error.
+// The store is left unchanged if the removal cannot be persisted.
+func (s *volumeStore) deleteVolume(volumeID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, existed := s.volumes[volumeID]
+	delete(s.volumes, volumeID)
+	if err := s.persistVolumes(); err != nil {
+		if existed {
+			s.volumes[volumeID] = old
+		}
+		return err
+	}
+	return nil
+}
+
+// nextXFSProjectID returns an XFS project ID which is neither used by a
+// volume nor returned by an earlier call.
+func (s *volumeStore) nextXFSProjectID() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := uint32(firstXFSProjectID)
+	if s.lastProjectID >= id {
+		id = s.lastProjectID + 1
+	}
+	for _, vol := range s.volumes {
+		if vol.VolProjectID >= id {
+			id = vol.VolProjectID + 1
+		}
+	}
+	s.lastProjectID = id
+	return id
+}
+
+func (s *volumeStore) getSnapshotByID(snapshotID string) (hostPathSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if snapshot, ok := s.snapshots[snapshotID]; ok {
+		return snapshot, nil
+	}
+	return hostPathSnapshot{}, fmt.Errorf("snapshot id %s does not exist in the snapshots list", snapshotID)
+}
+
+func (s *volumeStore) getSnapshotByName(name string) (hostPathSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, snapshot := range s.snapshots {
+		if snapshot.Name == name {
+			return snapshot, nil
+		}
+	}
+	return hostPathSnapshot{}, fmt.Errorf("snapshot name %s does not exist in the snapshots list", name)
+}
+
+// listSnapshots returns the snapshots of volumeID, or all snapshots if
+// volumeID is empty, sorted by ID.
+func (s *volumeStore) listSnapshots(volumeID string) []hostPathSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var snapshots []hostPathSnapshot
+	for _, snapshot := range s.snapshots {
+		if len(volumeID) != 0 && snapshot.VolID != volumeID {
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Id < snapshots[j].Id
+	})
+	return snapshots
+}
+
+// addSnapshot adds a snapshot. The store is left unchanged if the snapshot
+// cannot be persisted.
+func (s *volumeStore) addSnapshot(snapshot hostPathSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[snapshot.Id] = snapshot
+	if err := s.persistSnapshots(); err != nil {
+		delete(s.snapshots, snapshot.Id)
+		return err
+	}
+	return nil
+}
+
+// deleteSnapshot removes a snapshot, removing an unknown snapshot is not an
+// error. The store is left unchanged if the removal cannot be persisted.
+func (s *volumeStore) deleteSnapshot(snapshotID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, existed := s.snapshots[snapshotID]
+	delete(s.snapshots, snapshotID)
+	if err := s.persistSnapshots(); err != nil {
+		if existed {
+			s.snapshots[snapshotID] = old
+		}
+		return err
+	}
+	return nil
+}
+
+// persistVolumes writes the volume list to the catalog, if any. s.mu must be
+// held.
+func (s *volumeStore) persistVolumes() error {
+	if s.catalog == nil {
+		return nil
+	}
+	return s.catalog.saveVolumes(s.volumes)
+}
+
+// persistSnapshots writes the snapshot list to the catalog, if any. s.mu must
+// be held.
+func (s *volumeStore) persistSnapshots() error {
+	if s.catalog == nil {
+		return nil
+	}
+	return s.catalog.saveSnapshots(s.snapshots)
+}
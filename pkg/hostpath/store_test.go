@@ -0,0 +1,135 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+func TestOperationLocks(t *testing.T) {
+	s := newVolumeStore()
+
+	assert.True(t, s.tryLock(volumeNameKey("a")))
+	assert.False(t, s.tryLock(volumeNameKey("a")))
+
+	// Test that no lock is taken if one of them is held
+	assert.False(t, s.tryLock(volumeIDKey("b"), volumeNameKey("a")))
+	assert.True(t, s.tryLock(volumeIDKey("b")))
+	s.unlock(volumeIDKey("b"))
+
+	s.unlock(volumeNameKey("a"))
+	assert.True(t, s.tryLock(volumeNameKey("a")))
+}
+
+func TestVolumeStore(t *testing.T) {
+	s := newVolumeStore()
+
+	assert.NoError(t, s.addVolume(hostPathVolume{VolName: "b", VolID: "id2"}))
+	assert.NoError(t, s.addVolume(hostPathVolume{VolName: "a", VolID: "id1"}))
+	vol, err := s.getVolumeByName("b")
+	assert.NoError(t, err)
+	assert.Equal(t, "id2", vol.VolID)
+	vols := s.listVolumes()
+	assert.Equal(t, 2, len(vols))
+	assert.Equal(t, "id1", vols[0].VolID)
+
+	assert.NoError(t, s.updateVolume("id2", func(vol *hostPathVolume) {
+		vol.VolTargets = append(vol.VolTargets, "/target")
+	}))
+	vol, err = s.getVolumeByID("id2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/target"}, vol.VolTargets)
+	assert.Error(t, s.updateVolume("missing", func(vol *hostPathVolume) {}))
+
+	assert.NoError(t, s.deleteVolume("id2"))
+	_, err = s.getVolumeByID("id2")
+	assert.Error(t, err)
+
+	assert.NoError(t, s.addSnapshot(hostPathSnapshot{Name: "snap", Id: "snap1", VolID: "id1"}))
+	assert.NoError(t, s.addSnapshot(hostPathSnapshot{Name: "other", Id: "snap2", VolID: "id3"}))
+	assert.Equal(t, 2, len(s.listSnapshots("")))
+	assert.Equal(t, 1, len(s.listSnapshots("id1")))
+	assert.NoError(t, s.deleteSnapshot("snap1"))
+	_, err = s.getSnapshotByName("snap")
+	assert.Error(t, err)
+}
+
+func TestVolumeStorePersistFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostpath-catalog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := newVolumeStore()
+	assert.NoError(t, s.addVolume(hostPathVolume{VolName: "a", VolID: "id1"}))
+	assert.NoError(t, s.addSnapshot(hostPathSnapshot{Name: "snap", Id: "snap1", VolID: "id1"}))
+
+	// Test that a removal which cannot be persisted is rolled back
+	s.catalog = &volumeCatalog{dir: filepath.Join(dir, "missing")}
+	assert.Error(t, s.deleteVolume("id1"))
+	_, err = s.getVolumeByID("id1")
+	assert.NoError(t, err)
+	assert.Error(t, s.deleteSnapshot("snap1"))
+	_, err = s.getSnapshotByID("snap1")
+	assert.NoError(t, err)
+}
+
+func TestNextXFSProjectID(t *testing.T) {
+	s := newVolumeStore()
+	assert.Equal(t, uint32(firstXFSProjectID), s.nextXFSProjectID())
+
+	// Test that an ID is not handed out twice before it is used
+	assert.Equal(t, uint32(firstXFSProjectID+1), s.nextXFSProjectID())
+
+	s.volumes["a"] = hostPathVolume{VolID: "a", VolProjectID: firstXFSProjectID + 4}
+	s.volumes["b"] = hostPathVolume{VolID: "b"}
+	assert.Equal(t, uint32(firstXFSProjectID+5), s.nextXFSProjectID())
+}
+
+func TestConcurrentOperationsAbort(t *testing.T) {
+	d := csicommon.NewCSIDriver("hostpath.test", vendorVersion, "node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	})
+	cs := NewControllerServer(d, capacityModeNone, map[string]string{defaultPool: "/nonexistent"}, nil)
+
+	// Pretend that operations for the volume are in flight
+	assert.True(t, store.tryLock(volumeNameKey("vol"), volumeIDKey("id")))
+	defer store.unlock(volumeNameKey("vol"), volumeIDKey("id"))
+
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "id"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+)
+
+// ParseTopology returns the topology segments described by spec, a comma
+// separated list of key=value pairs, e.g.
+// "topology.hostpath.csi/zone=zone-a,topology.hostpath.csi/region=region-1".
+// An empty spec means that the node has no topology.
+func ParseTopology(spec string) (map[string]string, error) {
+	segments := map[string]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("hostpath: invalid topology segment %q, expected key=value", entry)
+		}
+		if _, ok := segments[kv[0]]; ok {
+			return nil, fmt.Errorf("hostpath: duplicate topology key %q", kv[0])
+		}
+		segments[kv[0]] = kv[1]
+	}
+	return segments, nil
+}
+
+// topologyMatches reports whether every segment of t has the same value in
+// the node segments.
+func topologyMatches(node map[string]string, t *csi.Topology) bool {
+	for key, value := range t.GetSegments() {
+		if node[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// requirementSatisfied reports whether a volume created on a node with the
+// given segments satisfies req. Hostpath volumes are only accessible from the
+// node they are created on, so the node must match one of the requisite
+// topologies. Without requisite topologies any node is acceptable.
+func requirementSatisfied(node map[string]string, req *csi.TopologyRequirement) bool {
+	if len(req.GetRequisite()) == 0 {
+		return true
+	}
+	for _, t := range req.GetRequisite() {
+		if topologyMatches(node, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessibleTopology returns the topology a volume with the given segments
+// is accessible from, or nil if it has none.
+func accessibleTopology(segments map[string]string) []*csi.Topology {
+	if len(segments) == 0 {
+		return nil
+	}
+	return []*csi.Topology{{Segments: segments}}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+const (
+	zoneKey   = "topology.hostpath.csi/zone"
+	regionKey = "topology.hostpath.csi/region"
+)
+
+func TestParseTopology(t *testing.T) {
+	segments, err := ParseTopology("")
+	assert.NoError(t, err)
+	assert.Zero(t, len(segments))
+
+	segments, err = ParseTopology(zoneKey + "=zone-a, " + regionKey + "=region-1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{zoneKey: "zone-a", regionKey: "region-1"}, segments)
+
+	_, err = ParseTopology(zoneKey)
+	assert.Error(t, err)
+	_, err = ParseTopology(zoneKey + "=a," + zoneKey + "=b")
+	assert.Error(t, err)
+}
+
+func TestRequirementSatisfied(t *testing.T) {
+	node := map[string]string{zoneKey: "zone-a", regionKey: "region-1"}
+	zoneA := &csi.Topology{Segments: map[string]string{zoneKey: "zone-a"}}
+	zoneB := &csi.Topology{Segments: map[string]string{zoneKey: "zone-b"}}
+
+	assert.True(t, requirementSatisfied(node, nil))
+	assert.True(t, requirementSatisfied(node, &csi.TopologyRequirement{Preferred: []*csi.Topology{zoneB}}))
+	assert.True(t, requirementSatisfied(node, &csi.TopologyRequirement{Requisite: []*csi.Topology{zoneB, zoneA}}))
+	assert.False(t, requirementSatisfied(node, &csi.TopologyRequirement{Requisite: []*csi.Topology{zoneB}}))
+	assert.False(t, requirementSatisfied(nil, &csi.TopologyRequirement{Requisite: []*csi.Topology{zoneA}}))
+
+	assert.Nil(t, accessibleTopology(nil))
+	assert.Equal(t, node, accessibleTopology(node)[0].GetSegments())
+}
+
+func TestCreateVolumeTopologyMismatch(t *testing.T) {
+	d := csicommon.NewCSIDriver("hostpath.test", vendorVersion, "node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	})
+	cs := NewControllerServer(d, capacityModeNone, map[string]string{defaultPool: "/nonexistent"},
+		map[string]string{zoneKey: "zone-a"})
+
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "topology-vol",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: map[string]string{zoneKey: "zone-b"}}},
+		},
+	})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestNodeGetInfoTopology(t *testing.T) {
+	segments := map[string]string{zoneKey: "zone-a"}
+	ns := NewNodeServer(csicommon.NewCSIDriver("hostpath.test", vendorVersion, "node"), "/nonexistent", segments)
+	resp, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "node", resp.GetNodeId())
+	assert.Equal(t, segments, resp.GetAccessibleTopology().GetSegments())
+}
@@ -19,6 +19,8 @@ package iscsi
 import (
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/kubernetes/pkg/volume/util"
 
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
@@ -58,8 +60,14 @@ func NewDriver(nodeID, endpoint string) *driver {
 }
 
 func NewNodeServer(d *driver) *nodeServer {
+	exec := mount.NewOsExec()
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d.csiDriver),
+		mounter:           mount.New(""),
+		exec:              exec,
+		iscsiadm:          NewISCSIAdm(exec),
+		multipath:         newMultipathManager(util.NewDeviceHandler(util.NewIOHandler()), exec),
+		byPathDir:         "/dev/disk/by-path",
 	}
 }
 
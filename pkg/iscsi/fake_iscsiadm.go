@@ -0,0 +1,350 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iscsi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FakeISCSIAdm is an in-memory ISCSIAdm for tests. It simulates the records
+// of open-iscsi, the targets of portals and the sessions to them, and
+// creates and removes the by-path files of the LUNs of logged in targets in
+// a directory.
+type FakeISCSIAdm struct {
+	mutex     sync.Mutex
+	byPathDir string
+	targets   []*FakeTarget
+	ifaces    map[string]map[string]string
+	discovery map[fakeRecord]map[string]string
+	nodes     map[fakeRecord]map[string]string
+	sessions  []fakeSession
+	nextSID   int
+}
+
+// FakeTarget is a target reachable at a portal. Logging in requires session
+// CHAP if Username is set.
+type FakeTarget struct {
+	Portal   string
+	Iqn      string
+	Luns     []int
+	Username string
+	Password string
+}
+
+// fakeRecord is the key of discovery and node records. Discovery records
+// have no iqn.
+type fakeRecord struct {
+	portal string
+	iqn    string
+	iface  string
+}
+
+type fakeSession struct {
+	ISCSISession
+	iface string
+}
+
+var _ ISCSIAdm = &FakeISCSIAdm{}
+
+// NewFakeISCSIAdm returns a FakeISCSIAdm with the default tcp iface and
+// without targets. By-path files are created in byPathDir.
+func NewFakeISCSIAdm(byPathDir string) *FakeISCSIAdm {
+	return &FakeISCSIAdm{
+		byPathDir: byPathDir,
+		ifaces: map[string]map[string]string{
+			"default": {
+				"iface.iscsi_ifacename": "default",
+				"iface.transport_name":  "tcp",
+				"iface.initiatorname":   "",
+			},
+		},
+		discovery: make(map[fakeRecord]map[string]string),
+		nodes:     make(map[fakeRecord]map[string]string),
+		nextSID:   1,
+	}
+}
+
+// AddTarget makes a target reachable. LUNs added to a target which is
+// logged in show up on the next rescan.
+func (f *FakeISCSIAdm) AddTarget(target FakeTarget) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for i, t := range f.targets {
+		if t.Portal == target.Portal && t.Iqn == target.Iqn {
+			f.targets[i] = &target
+			return
+		}
+	}
+	f.targets = append(f.targets, &target)
+}
+
+func (f *FakeISCSIAdm) ShowIface(iface string) (map[string]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	settings, ok := f.ifaces[iface]
+	if !ok {
+		return nil, fmt.Errorf("Could not read iface %s (22)", iface)
+	}
+	params := make(map[string]string)
+	for k, v := range settings {
+		params[k] = v
+	}
+	return params, nil
+}
+
+func (f *FakeISCSIAdm) CreateIface(iface string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.ifaces[iface]; ok {
+		return fmt.Errorf("Could not create new interface %s (6)", iface)
+	}
+	f.ifaces[iface] = map[string]string{
+		"iface.iscsi_ifacename": iface,
+		"iface.transport_name":  "tcp",
+	}
+	return nil
+}
+
+func (f *FakeISCSIAdm) UpdateIface(iface, key, value string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	settings, ok := f.ifaces[iface]
+	if !ok {
+		return fmt.Errorf("Could not read iface %s (22)", iface)
+	}
+	if key == "iface.iscsi_ifacename" {
+		return fmt.Errorf("Cannot update %s (7)", key)
+	}
+	settings[key] = value
+	return nil
+}
+
+func (f *FakeISCSIAdm) DeleteIface(iface string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if iface == "default" {
+		return fmt.Errorf("iface %s is a special interface and cannot be deleted (7)", iface)
+	}
+	if _, ok := f.ifaces[iface]; !ok {
+		return fmt.Errorf("Could not read iface %s (22)", iface)
+	}
+	delete(f.ifaces, iface)
+	return nil
+}
+
+func (f *FakeISCSIAdm) CreateDiscovery(portal, iface string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.ifaces[iface]; !ok {
+		return fmt.Errorf("Could not read iface %s (22)", iface)
+	}
+	record := fakeRecord{portal: portal, iface: iface}
+	if _, ok := f.discovery[record]; !ok {
+		f.discovery[record] = make(map[string]string)
+	}
+	return nil
+}
+
+func (f *FakeISCSIAdm) UpdateDiscovery(portal, iface, key, value string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	settings, ok := f.discovery[fakeRecord{portal: portal, iface: iface}]
+	if !ok {
+		return fmt.Errorf("No records found (21)")
+	}
+	settings[key] = value
+	return nil
+}
+
+func (f *FakeISCSIAdm) Discover(portal, iface string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.discovery[fakeRecord{portal: portal, iface: iface}]; !ok {
+		return fmt.Errorf("No records found (21)")
+	}
+	found := false
+	for _, t := range f.targets {
+		if t.Portal != portal {
+			continue
+		}
+		found = true
+		record := fakeRecord{portal: portal, iqn: t.Iqn, iface: iface}
+		if _, ok := f.nodes[record]; !ok {
+			f.nodes[record] = make(map[string]string)
+		}
+	}
+	if !found {
+		return fmt.Errorf("cannot make connection to %s: Connection refused (4)", portal)
+	}
+	return nil
+}
+
+func (f *FakeISCSIAdm) DeleteDiscovery(portal, iface string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	record := fakeRecord{portal: portal, iface: iface}
+	if _, ok := f.discovery[record]; !ok {
+		return fmt.Errorf("No records found (21)")
+	}
+	delete(f.discovery, record)
+	return nil
+}
+
+func (f *FakeISCSIAdm) UpdateNode(portal, iqn, iface, key, value string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	settings, ok := f.nodes[fakeRecord{portal: portal, iqn: iqn, iface: iface}]
+	if !ok {
+		return fmt.Errorf("No records found (21)")
+	}
+	settings[key] = value
+	return nil
+}
+
+func (f *FakeISCSIAdm) DeleteNode(portal, iqn, iface string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	record := fakeRecord{portal: portal, iqn: iqn, iface: iface}
+	if _, ok := f.nodes[record]; !ok {
+		return fmt.Errorf("No records found (21)")
+	}
+	delete(f.nodes, record)
+	return nil
+}
+
+func (f *FakeISCSIAdm) Login(portal, iqn, iface string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	settings, ok := f.nodes[fakeRecord{portal: portal, iqn: iqn, iface: iface}]
+	if !ok {
+		return fmt.Errorf("No records found (21)")
+	}
+	target := f.target(portal, iqn)
+	if target == nil {
+		return fmt.Errorf("Login to [iface: %s, target: %s, portal: %s] failed: target not found (3)", iface, iqn, portal)
+	}
+	if target.Username != "" && (settings["node.session.auth.authmethod"] != "CHAP" ||
+		settings["node.session.auth.username"] != target.Username ||
+		settings["node.session.auth.password"] != target.Password) {
+		return fmt.Errorf("Login to [iface: %s, target: %s, portal: %s] failed: authorization failure (24)", iface, iqn, portal)
+	}
+	for _, s := range f.sessions {
+		if s.Portal == portal && s.Iqn == iqn && s.iface == iface {
+			return fmt.Errorf("session exists (15)")
+		}
+	}
+	f.sessions = append(f.sessions, fakeSession{
+		ISCSISession: ISCSISession{Transport: f.ifaces[iface]["iface.transport_name"], SID: f.nextSID, Portal: portal, Iqn: iqn},
+		iface:        iface,
+	})
+	f.nextSID++
+	return f.createByPathFiles(target)
+}
+
+func (f *FakeISCSIAdm) Logout(portal, iqn, iface string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var sessions []fakeSession
+	for _, s := range f.sessions {
+		if s.Portal != portal || s.Iqn != iqn || (iface != "" && s.iface != iface) {
+			sessions = append(sessions, s)
+		}
+	}
+	if len(sessions) == len(f.sessions) {
+		return fmt.Errorf("No matching sessions found (21)")
+	}
+	f.sessions = sessions
+	if f.hasSession(portal, iqn) {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(f.byPathDir, byPathPrefix(portal, iqn)+"*"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FakeISCSIAdm) Rescan(portal, iqn string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.hasSession(portal, iqn) {
+		return fmt.Errorf("No session found (21)")
+	}
+	target := f.target(portal, iqn)
+	if target == nil {
+		return nil
+	}
+	return f.createByPathFiles(target)
+}
+
+func (f *FakeISCSIAdm) ListSessions() ([]ISCSISession, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var sessions []ISCSISession
+	for _, s := range f.sessions {
+		sessions = append(sessions, s.ISCSISession)
+	}
+	return sessions, nil
+}
+
+func (f *FakeISCSIAdm) target(portal, iqn string) *FakeTarget {
+	for _, t := range f.targets {
+		if t.Portal == portal && t.Iqn == iqn {
+			return t
+		}
+	}
+	return nil
+}
+
+func (f *FakeISCSIAdm) hasSession(portal, iqn string) bool {
+	for _, s := range f.sessions {
+		if s.Portal == portal && s.Iqn == iqn {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FakeISCSIAdm) createByPathFiles(target *FakeTarget) error {
+	if err := os.MkdirAll(f.byPathDir, 0755); err != nil {
+		return err
+	}
+	for _, lun := range target.Luns {
+		file := filepath.Join(f.byPathDir, byPathPrefix(target.Portal, target.Iqn)+strconv.Itoa(lun))
+		if err := ioutil.WriteFile(file, nil, 0640); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// byPathPrefix returns the prefix of the by-path names of the LUNs of a
+// target, the name ends with the LUN.
+func byPathPrefix(portal, iqn string) string {
+	return strings.Join([]string{"ip", portal, "iscsi", iqn, "lun", ""}, "-")
+}
@@ -22,11 +22,11 @@ import (
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/golang/glog"
 	"k8s.io/kubernetes/pkg/util/mount"
-	"k8s.io/kubernetes/pkg/volume/util"
 )
 
-func getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
+func getISCSIInfo(req *csi.NodeStageVolumeRequest) (*iscsiDisk, error) {
 	volName := req.GetVolumeId()
 	tp := req.GetVolumeAttributes()["targetPortal"]
 	iqn := req.GetVolumeAttributes()["iqn"]
@@ -36,8 +36,15 @@ func getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
 	}
 
 	portalList := req.GetVolumeAttributes()["portals"]
-	secretParams := req.GetVolumeAttributes()["secret"]
-	secret := parseSecret(secretParams)
+	secret := req.GetNodeStageSecrets()
+	if len(secret) == 0 {
+		// Deprecated: CHAP credentials in the volume attributes are stored
+		// in plain text in the PV
+		if secretParams := req.GetVolumeAttributes()["secret"]; secretParams != "" {
+			glog.Warningf("iscsi: volume %s takes CHAP credentials from the deprecated \"secret\" attribute, use node stage secrets instead", volName)
+			secret = parseSecret(secretParams)
+		}
+	}
 
 	portal := portalMounter(tp)
 	var bkportal []string
@@ -53,6 +60,9 @@ func getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
 	}
 
 	iface := req.GetVolumeAttributes()["iscsiInterface"]
+	if iface == "" {
+		iface = "default"
+	}
 	initiatorName := req.GetVolumeAttributes()["initiatorName"]
 	chapDiscovery := false
 	if req.GetVolumeAttributes()["discoveryCHAPAuth"] == "true" {
@@ -64,42 +74,56 @@ func getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
 		chapSession = true
 	}
 
+	requireMultipath := false
+	if req.GetVolumeAttributes()["requireMultipath"] == "true" {
+		requireMultipath = true
+	}
+
 	return &iscsiDisk{
-		VolName:        volName,
-		Portals:        bkportal,
-		Iqn:            iqn,
-		lun:            lun,
-		Iface:          iface,
-		chap_discovery: chapDiscovery,
-		chap_session:   chapSession,
-		secret:         secret,
-		InitiatorName:  initiatorName}, nil
+		VolName:          volName,
+		Portals:          bkportal,
+		Iqn:              iqn,
+		lun:              lun,
+		Iface:            iface,
+		chap_discovery:   chapDiscovery,
+		chap_session:     chapSession,
+		secret:           secret,
+		InitiatorName:    initiatorName,
+		RequireMultipath: requireMultipath}, nil
 }
 
-func getISCSIDiskMounter(iscsiInfo *iscsiDisk, req *csi.NodePublishVolumeRequest) *iscsiDiskMounter {
-	readOnly := req.GetReadonly()
+// getISCSIDiskMounter returns the mounter of the disk at the staging path. The
+// disk is mounted read only for reader only access modes, publishing bind
+// mounts it read only or read write per target.
+func (ns *nodeServer) getISCSIDiskMounter(iscsiInfo *iscsiDisk, req *csi.NodeStageVolumeRequest) *iscsiDiskMounter {
+	mode := req.GetVolumeCapability().GetAccessMode().GetMode()
+	readOnly := mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
 	fsType := req.GetVolumeCapability().GetMount().GetFsType()
 	mountOptions := req.GetVolumeCapability().GetMount().GetMountFlags()
 
+	iscsiInfo.Block = req.GetVolumeCapability().GetBlock() != nil
 	return &iscsiDiskMounter{
 		iscsiDisk:    iscsiInfo,
 		fsType:       fsType,
 		readOnly:     readOnly,
 		mountOptions: mountOptions,
-		mounter:      &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: mount.NewOsExec()},
-		exec:         mount.NewOsExec(),
-		targetPath:   req.GetTargetPath(),
-		deviceUtil:   util.NewDeviceHandler(util.NewIOHandler()),
+		mounter:      &mount.SafeFormatAndMount{Interface: ns.mounter, Exec: ns.exec},
+		iscsiadm:     ns.iscsiadm,
+		multipath:    ns.multipath,
+		byPathDir:    ns.byPathDir,
+		targetPath:   req.GetStagingTargetPath(),
 	}
 }
 
-func getISCSIDiskUnmounter(req *csi.NodeUnpublishVolumeRequest) *iscsiDiskUnmounter {
+func (ns *nodeServer) getISCSIDiskUnmounter(req *csi.NodeUnstageVolumeRequest) *iscsiDiskUnmounter {
 	return &iscsiDiskUnmounter{
 		iscsiDisk: &iscsiDisk{
 			VolName: req.GetVolumeId(),
 		},
-		mounter: mount.New(""),
-		exec:    mount.NewOsExec(),
+		mounter:   ns.mounter,
+		iscsiadm:  ns.iscsiadm,
+		multipath: ns.multipath,
 	}
 }
 
@@ -128,6 +152,12 @@ type iscsiDisk struct {
 	secret         map[string]string
 	InitiatorName  string
 	VolName        string
+	// Block is set for raw block volumes, which are not formatted
+	Block bool
+	// RequireMultipath fails attaching a disk without a multipath device
+	RequireMultipath bool
+	// DevicePath is the attached device, saved for DetachDisk
+	DevicePath string
 }
 
 type iscsiDiskMounter struct {
@@ -136,13 +166,16 @@ type iscsiDiskMounter struct {
 	fsType       string
 	mountOptions []string
 	mounter      *mount.SafeFormatAndMount
-	exec         mount.Exec
-	deviceUtil   util.DeviceUtil
-	targetPath   string
+	iscsiadm     ISCSIAdm
+	multipath    *multipathManager
+	// byPathDir is the directory of the /dev/disk/by-path links of disks
+	byPathDir  string
+	targetPath string
 }
 
 type iscsiDiskUnmounter struct {
 	*iscsiDisk
-	mounter mount.Interface
-	exec    mount.Exec
+	mounter   mount.Interface
+	iscsiadm  ISCSIAdm
+	multipath *multipathManager
 }
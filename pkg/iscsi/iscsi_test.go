@@ -0,0 +1,80 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iscsi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetISCSIInfoSecrets(t *testing.T) {
+	attributes := map[string]string{
+		"targetPortal":    "10.0.0.1",
+		"iqn":             "iqn.2018-01.io.k8s:target",
+		"lun":             "0",
+		"portals":         `["10.0.0.2:3260"]`,
+		"sessionCHAPAuth": "true",
+		"secret":          `{"node.session.auth.username": "attribute-user"}`,
+	}
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:         "vol",
+		VolumeAttributes: attributes,
+		NodeStageSecrets: map[string]string{"node.session.auth.username": "secret-user"},
+	}
+
+	// Test that node stage secrets take precedence over the attribute
+	disk, err := getISCSIInfo(req)
+	assert.NoError(t, err)
+	assert.True(t, disk.chap_session)
+	assert.Equal(t, []string{"10.0.0.1:3260", "10.0.0.2:3260"}, disk.Portals)
+	assert.Equal(t, "secret-user", disk.secret["node.session.auth.username"])
+
+	// Test the deprecated attribute
+	req.NodeStageSecrets = nil
+	disk, err = getISCSIInfo(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "attribute-user", disk.secret["node.session.auth.username"])
+}
+
+func TestPersistISCSIWithoutSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	disk := iscsiDisk{
+		VolName: "vol",
+		Iqn:     "iqn.2018-01.io.k8s:target",
+		Portals: []string{"10.0.0.1:3260"},
+		secret:  map[string]string{"node.session.auth.password": "chap-password"},
+	}
+	util := &ISCSIUtil{}
+	assert.NoError(t, util.persistISCSI(disk, dir))
+	content, err := ioutil.ReadFile(filepath.Join(dir, "vol.json"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), "chap-password")
+	assert.NotContains(t, string(content), "auth")
+
+	loaded := iscsiDisk{VolName: "vol"}
+	assert.NoError(t, util.loadISCSI(&loaded, dir))
+	assert.Equal(t, disk.Iqn, loaded.Iqn)
+	assert.Nil(t, loaded.secret)
+}
@@ -22,7 +22,6 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 
@@ -42,24 +41,26 @@ var (
 		"node.session.auth.password",
 		"node.session.auth.username_in",
 		"node.session.auth.password_in"}
-	ifaceTransportNameRe = regexp.MustCompile(`iface.transport_name = (.*)\n`)
 )
 
+// blockDeviceFile is the file in the staging path of a raw block volume the
+// disk is bind mounted on
+const blockDeviceFile = "device"
+
 func updateISCSIDiscoverydb(b iscsiDiskMounter, tp string) error {
 	if !b.chap_discovery {
 		return nil
 	}
-	out, err := b.exec.Run("iscsiadm", "-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "-o", "update", "-n", "discovery.sendtargets.auth.authmethod", "-v", "CHAP")
+	err := b.iscsiadm.UpdateDiscovery(tp, b.Iface, "discovery.sendtargets.auth.authmethod", "CHAP")
 	if err != nil {
-		return fmt.Errorf("iscsi: failed to update discoverydb with CHAP, output: %v", string(out))
+		return fmt.Errorf("iscsi: failed to update discoverydb with CHAP, error: %v", err)
 	}
 
 	for _, k := range chap_st {
 		v := b.secret[k]
 		if len(v) > 0 {
-			out, err := b.exec.Run("iscsiadm", "-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "-o", "update", "-n", k, "-v", v)
-			if err != nil {
-				return fmt.Errorf("iscsi: failed to update discoverydb key %q with value %q error: %v", k, v, string(out))
+			if err := b.iscsiadm.UpdateDiscovery(tp, b.Iface, k, v); err != nil {
+				return fmt.Errorf("iscsi: failed to update discoverydb key %q error: %v", k, err)
 			}
 		}
 	}
@@ -71,17 +72,16 @@ func updateISCSINode(b iscsiDiskMounter, tp string) error {
 		return nil
 	}
 
-	out, err := b.exec.Run("iscsiadm", "-m", "node", "-p", tp, "-T", b.Iqn, "-I", b.Iface, "-o", "update", "-n", "node.session.auth.authmethod", "-v", "CHAP")
+	err := b.iscsiadm.UpdateNode(tp, b.Iqn, b.Iface, "node.session.auth.authmethod", "CHAP")
 	if err != nil {
-		return fmt.Errorf("iscsi: failed to update node with CHAP, output: %v", string(out))
+		return fmt.Errorf("iscsi: failed to update node with CHAP, error: %v", err)
 	}
 
 	for _, k := range chap_sess {
 		v := b.secret[k]
 		if len(v) > 0 {
-			out, err := b.exec.Run("iscsiadm", "-m", "node", "-p", tp, "-T", b.Iqn, "-I", b.Iface, "-o", "update", "-n", k, "-v", v)
-			if err != nil {
-				return fmt.Errorf("iscsi: failed to update node session key %q with value %q error: %v", k, v, string(out))
+			if err := b.iscsiadm.UpdateNode(tp, b.Iqn, b.Iface, k, v); err != nil {
+				return fmt.Errorf("iscsi: failed to update node session key %q error: %v", k, err)
 			}
 		}
 	}
@@ -134,6 +134,8 @@ func waitForPathToExistInternal(devicePath *string, maxRetries int, deviceTransp
 
 type ISCSIUtil struct{}
 
+// persistISCSI saves conf for DetachDisk. The CHAP credentials are
+// unexported and never encoded, detaching does not need them.
 func (util *ISCSIUtil) persistISCSI(conf iscsiDisk, mnt string) error {
 	file := path.Join(mnt, conf.VolName+".json")
 	fp, err := os.Create(file)
@@ -163,19 +165,37 @@ func (util *ISCSIUtil) loadISCSI(conf *iscsiDisk, mnt string) error {
 	return nil
 }
 
+// AttachDisk logs in to the target, formats the disk if needed and mounts it
+// at b.targetPath, the staging path of the volume. It does nothing if the
+// staging path is already mounted.
 func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 	var devicePath string
 	var devicePaths []string
 	var iscsiTransport string
 	var lastErr error
 
-	out, err := b.exec.Run("iscsiadm", "-m", "iface", "-I", b.Iface, "-o", "show")
+	// Check the mount first so that retries do not log in again
+	mntPath := b.targetPath
+	checkPath := mntPath
+	if b.Block {
+		checkPath = stagedBlockDevice(mntPath)
+	}
+	notMnt, err := b.mounter.IsLikelyNotMountPoint(checkPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("Heuristic determination of mount point failed:%v", err)
+	}
+	if err == nil && !notMnt {
+		glog.Infof("iscsi: %s already mounted", checkPath)
+		return "", nil
+	}
+
+	params, err := b.iscsiadm.ShowIface(b.Iface)
 	if err != nil {
-		glog.Errorf("iscsi: could not read iface %s error: %s", b.Iface, string(out))
+		glog.Errorf("iscsi: could not read iface %s error: %v", b.Iface, err)
 		return "", err
 	}
 
-	iscsiTransport = extractTransportname(string(out))
+	iscsiTransport = extractTransportname(params)
 
 	bkpPortal := b.Portals
 
@@ -195,9 +215,8 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 	for _, tp := range bkpPortal {
 		// Rescan sessions to discover newly mapped LUNs. Do not specify the interface when rescanning
 		// to avoid establishing additional sessions to the same target.
-		out, err := b.exec.Run("iscsiadm", "-m", "node", "-p", tp, "-T", b.Iqn, "-R")
-		if err != nil {
-			glog.Errorf("iscsi: failed to rescan session with error: %s (%v)", string(out), err)
+		if err := b.iscsiadm.Rescan(tp, b.Iqn); err != nil {
+			glog.Errorf("iscsi: failed to rescan session with error: %v", err)
 		}
 
 		if iscsiTransport == "" {
@@ -205,9 +224,9 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 			return "", fmt.Errorf("Could not parse iface file for %s", b.Iface)
 		}
 		if iscsiTransport == "tcp" {
-			devicePath = strings.Join([]string{"/dev/disk/by-path/ip", tp, "iscsi", b.Iqn, "lun", b.lun}, "-")
+			devicePath = filepath.Join(b.byPathDir, strings.Join([]string{"ip", tp, "iscsi", b.Iqn, "lun", b.lun}, "-"))
 		} else {
-			devicePath = strings.Join([]string{"/dev/disk/by-path/pci", "*", "ip", tp, "iscsi", b.Iqn, "lun", b.lun}, "-")
+			devicePath = filepath.Join(b.byPathDir, strings.Join([]string{"pci", "*", "ip", tp, "iscsi", b.Iqn, "lun", b.lun}, "-"))
 		}
 
 		if exist := waitForPathToExist(&devicePath, 1, iscsiTransport); exist {
@@ -216,18 +235,18 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 			continue
 		}
 		// build discoverydb and discover iscsi target
-		b.exec.Run("iscsiadm", "-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "-o", "new")
+		b.iscsiadm.CreateDiscovery(tp, b.Iface)
 		// update discoverydb with CHAP secret
 		err = updateISCSIDiscoverydb(b, tp)
 		if err != nil {
 			lastErr = fmt.Errorf("iscsi: failed to update discoverydb to portal %s error: %v", tp, err)
 			continue
 		}
-		out, err = b.exec.Run("iscsiadm", "-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "--discover")
+		err = b.iscsiadm.Discover(tp, b.Iface)
 		if err != nil {
 			// delete discoverydb record
-			b.exec.Run("iscsiadm", "-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "-o", "delete")
-			lastErr = fmt.Errorf("iscsi: failed to sendtargets to portal %s output: %s, err %v", tp, string(out), err)
+			b.iscsiadm.DeleteDiscovery(tp, b.Iface)
+			lastErr = fmt.Errorf("iscsi: failed to sendtargets to portal %s err %v", tp, err)
 			continue
 		}
 		err = updateISCSINode(b, tp)
@@ -237,11 +256,11 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 			continue
 		}
 		// login to iscsi target
-		out, err = b.exec.Run("iscsiadm", "-m", "node", "-p", tp, "-T", b.Iqn, "-I", b.Iface, "--login")
+		err = b.iscsiadm.Login(tp, b.Iqn, b.Iface)
 		if err != nil {
 			// delete the node record from database
-			b.exec.Run("iscsiadm", "-m", "node", "-p", tp, "-I", b.Iface, "-T", b.Iqn, "-o", "delete")
-			lastErr = fmt.Errorf("iscsi: failed to attach disk: Error: %s (%v)", string(out), err)
+			b.iscsiadm.DeleteNode(tp, b.Iqn, b.Iface)
+			lastErr = fmt.Errorf("iscsi: failed to attach disk: Error: %v", err)
 			continue
 		}
 		if exist := waitForPathToExist(&devicePath, 10, iscsiTransport); !exist {
@@ -256,7 +275,9 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 
 	if len(devicePaths) == 0 {
 		// delete cloned iface
-		b.exec.Run("iscsiadm", "-m", "iface", "-I", b.Iface, "-o", "delete")
+		if b.InitiatorName != "" {
+			b.iscsiadm.DeleteIface(b.Iface)
+		}
 		glog.Errorf("iscsi: failed to get any path for iscsi disk, last err seen:\n%v", lastErr)
 		return "", fmt.Errorf("failed to get any path for iscsi disk, last err seen:\n%v", lastErr)
 	}
@@ -268,38 +289,41 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 	devicePath = devicePaths[0]
 
 	// Mount device
-	mntPath := b.targetPath
-	notMnt, err := b.mounter.IsLikelyNotMountPoint(mntPath)
-	if err != nil && !os.IsNotExist(err) {
-		return "", fmt.Errorf("Heuristic determination of mount point failed:%v", err)
-	}
-	if !notMnt {
-		glog.Infof("iscsi: %s already mounted", mntPath)
-		return "", nil
-	}
-
 	if err := os.MkdirAll(mntPath, 0750); err != nil {
 		glog.Errorf("iscsi: failed to mkdir %s, error", mntPath)
 		return "", err
 	}
 
+	// If the disk is using mpio mount it via the dm-XX device once all
+	// paths joined it
+	mappedDevicePath, err := b.multipath.waitForPaths(devicePaths, b.RequireMultipath)
+	if err != nil {
+		glog.Errorf("iscsi: %v", err)
+		return "", err
+	}
+	if mappedDevicePath != "" {
+		devicePath = mappedDevicePath
+	}
+
 	// Persist iscsi disk config to json file for DetachDisk path
+	b.DevicePath = devicePath
 	if err := util.persistISCSI(*(b.iscsiDisk), b.targetPath); err != nil {
 		glog.Errorf("iscsi: failed to save iscsi config with error: %v", err)
 		return "", err
 	}
 
-	for _, path := range devicePaths {
-		// There shouldnt be any empty device paths. However adding this check
-		// for safer side to avoid the possibility of an empty entry.
-		if path == "" {
-			continue
+	if b.Block {
+		// Raw block disks are not formatted, the device node is bind
+		// mounted on a file in the staging path
+		stagedDevice := stagedBlockDevice(mntPath)
+		if err := makeFile(stagedDevice); err != nil {
+			return "", err
 		}
-		// check if the dev is using mpio and if so mount it via the dm-XX device
-		if mappedDevicePath := b.deviceUtil.FindMultipathDeviceForDevice(path); mappedDevicePath != "" {
-			devicePath = mappedDevicePath
-			break
+		if err := b.mounter.Mount(devicePath, stagedDevice, "", []string{"bind"}); err != nil {
+			glog.Errorf("iscsi: failed to bind mount iscsi device %s to %s, error %v", devicePath, stagedDevice, err)
+			return "", err
 		}
+		return devicePath, nil
 	}
 
 	var options []string
@@ -319,31 +343,55 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 	return devicePath, err
 }
 
+// DetachDisk unmounts the disk at targetPath, the staging path of the
+// volume, and logs out of the target. A disk which is already unmounted is
+// still logged out, so that a retry completes an interrupted detach.
 func (util *ISCSIUtil) DetachDisk(c iscsiDiskUnmounter, targetPath string) error {
-	_, cnt, err := mount.GetDeviceNameFromMount(c.mounter, targetPath)
-	if err != nil {
-		glog.Errorf("iscsi detach disk: failed to get device from mnt: %s\nError: %v", targetPath, err)
-		return err
-	}
-
 	if pathExists, pathErr := volumeutil.PathExists(targetPath); pathErr != nil {
 		return fmt.Errorf("Error checking if path exists: %v", pathErr)
 	} else if !pathExists {
 		glog.Warningf("Warning: Unmount skipped because path does not exist: %v", targetPath)
 		return nil
 	}
-	if err = c.mounter.Unmount(targetPath); err != nil {
-		glog.Errorf("iscsi detach disk: failed to unmount: %s\nError: %v", targetPath, err)
+
+	// The bind mount of a raw block disk reports the devtmpfs as its device,
+	// so its references cannot be counted here. NodeUnstageVolume refuses to
+	// detach a disk which is still published, see getBlockPublishes.
+	stagedDevice := stagedBlockDevice(targetPath)
+	if _, err := os.Stat(stagedDevice); err == nil {
+		if err := volumeutil.UnmountPath(stagedDevice, c.mounter); err != nil {
+			glog.Errorf("iscsi detach disk: failed to unmount: %s\nError: %v", stagedDevice, err)
+			return err
+		}
+	}
+
+	notMnt, err := c.mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil {
 		return err
 	}
-	cnt--
-	if cnt != 0 {
-		return nil
+	if !notMnt {
+		_, cnt, err := mount.GetDeviceNameFromMount(c.mounter, targetPath)
+		if err != nil {
+			glog.Errorf("iscsi detach disk: failed to get device from mnt: %s\nError: %v", targetPath, err)
+			return err
+		}
+		if err = c.mounter.Unmount(targetPath); err != nil {
+			glog.Errorf("iscsi detach disk: failed to unmount: %s\nError: %v", targetPath, err)
+			return err
+		}
+		cnt--
+		if cnt != 0 {
+			return nil
+		}
+	}
+
+	// Without a saved config the disk was never logged in by AttachDisk
+	if _, err := os.Stat(path.Join(targetPath, c.iscsiDisk.VolName+".json")); os.IsNotExist(err) {
+		return os.RemoveAll(targetPath)
 	}
 
 	var bkpPortal []string
 	var volName, iqn, iface, initiatorName string
-	found := true
 
 	// load iscsi disk config from json file
 	if err := util.loadISCSI(c.iscsiDisk, targetPath); err == nil {
@@ -358,32 +406,38 @@ func (util *ISCSIUtil) DetachDisk(c iscsiDiskUnmounter, targetPath string) error
 		return fmt.Errorf("iscsi detach disk: failed to detach iscsi disk. Couldn't get connected portals from configurations.")
 	}
 
+	// Flush the multipath device and delete the SCSI devices before logging
+	// out, a map of logged out paths stays behind otherwise
+	if err := c.multipath.detach(c.iscsiDisk.DevicePath); err != nil {
+		glog.Errorf("iscsi detach disk: %v", err)
+		return err
+	}
+
+	// Portals without a session were never logged in or are already logged
+	// out by an interrupted detach
+	sessions, err := c.iscsiadm.ListSessions()
+	if err != nil {
+		glog.Errorf("iscsi: failed to list sessions Error: %v", err)
+		return err
+	}
 	for _, portal := range portals {
-		logoutArgs := []string{"-m", "node", "-p", portal, "-T", iqn, "--logout"}
-		deleteArgs := []string{"-m", "node", "-p", portal, "-T", iqn, "-o", "delete"}
-		if found {
-			logoutArgs = append(logoutArgs, []string{"-I", iface}...)
-			deleteArgs = append(deleteArgs, []string{"-I", iface}...)
-		}
-		glog.Infof("iscsi: log out target %s iqn %s iface %s", portal, iqn, iface)
-		out, err := c.exec.Run("iscsiadm", logoutArgs...)
-		if err != nil {
-			glog.Errorf("iscsi: failed to detach disk Error: %s", string(out))
+		if hasSession(sessions, portal, iqn) {
+			glog.Infof("iscsi: log out target %s iqn %s iface %s", portal, iqn, iface)
+			if err := c.iscsiadm.Logout(portal, iqn, iface); err != nil {
+				glog.Errorf("iscsi: failed to detach disk Error: %v", err)
+			}
 		}
 		// Delete the node record
 		glog.Infof("iscsi: delete node record target %s iqn %s", portal, iqn)
-		out, err = c.exec.Run("iscsiadm", deleteArgs...)
-		if err != nil {
-			glog.Errorf("iscsi: failed to delete node record Error: %s", string(out))
+		if err := c.iscsiadm.DeleteNode(portal, iqn, iface); err != nil {
+			glog.Errorf("iscsi: failed to delete node record Error: %v", err)
 		}
 	}
 	// Delete the iface after all sessions have logged out
 	// If the iface is not created via iscsi plugin, skip to delete
-	if initiatorName != "" && found && iface == (portals[0]+":"+volName) {
-		deleteArgs := []string{"-m", "iface", "-I", iface, "-o", "delete"}
-		out, err := c.exec.Run("iscsiadm", deleteArgs...)
-		if err != nil {
-			glog.Errorf("iscsi: failed to delete iface Error: %s", string(out))
+	if initiatorName != "" && iface == (portals[0]+":"+volName) {
+		if err := c.iscsiadm.DeleteIface(iface); err != nil {
+			glog.Errorf("iscsi: failed to delete iface Error: %v", err)
 		}
 	}
 
@@ -395,20 +449,45 @@ func (util *ISCSIUtil) DetachDisk(c iscsiDiskUnmounter, targetPath string) error
 	return nil
 }
 
-func extractTransportname(ifaceOutput string) (iscsiTransport string) {
-	rexOutput := ifaceTransportNameRe.FindStringSubmatch(ifaceOutput)
-	if rexOutput == nil {
+// stagedBlockDevice returns the file in the staging path a raw block disk is
+// bind mounted on.
+func stagedBlockDevice(stagingPath string) string {
+	return filepath.Join(stagingPath, blockDeviceFile)
+}
+
+// makeFile creates an empty file to bind mount a device node on, if it does
+// not exist yet.
+func makeFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func extractTransportname(params map[string]string) (iscsiTransport string) {
+	iscsiTransport, ok := params["iface.transport_name"]
+	if !ok {
 		return ""
 	}
-	iscsiTransport = rexOutput[1]
 
 	// While iface.transport_name is a required parameter, handle it being unspecified anyways
-	if iscsiTransport == "<empty>" {
+	if iscsiTransport == "" {
 		iscsiTransport = "tcp"
 	}
 	return iscsiTransport
 }
 
+// hasSession returns whether there is a session to the target at portal
+func hasSession(sessions []ISCSISession, portal, iqn string) bool {
+	for _, session := range sessions {
+		if session.Portal == portal && session.Iqn == iqn {
+			return true
+		}
+	}
+	return false
+}
+
 // Remove duplicates or string
 func removeDuplicate(s []string) []string {
 	m := map[string]bool{}
@@ -422,54 +501,32 @@ func removeDuplicate(s []string) []string {
 	return s
 }
 
-func parseIscsiadmShow(output string) (map[string]string, error) {
-	params := make(map[string]string)
-	slice := strings.Split(output, "\n")
-	for _, line := range slice {
-		if !strings.HasPrefix(line, "iface.") || strings.Contains(line, "<empty>") {
-			continue
-		}
-		iface := strings.Fields(line)
-		if len(iface) != 3 || iface[1] != "=" {
-			return nil, fmt.Errorf("Error: invalid iface setting: %v", iface)
-		}
-		// iscsi_ifacename is immutable once the iface is created
-		if iface[0] == "iface.iscsi_ifacename" {
-			continue
-		}
-		params[iface[0]] = iface[2]
-	}
-	return params, nil
-}
-
 func cloneIface(b iscsiDiskMounter, newIface string) error {
 	var lastErr error
 	// get pre-configured iface records
-	out, err := b.exec.Run("iscsiadm", "-m", "iface", "-I", b.Iface, "-o", "show")
-	if err != nil {
-		lastErr = fmt.Errorf("iscsi: failed to show iface records: %s (%v)", string(out), err)
-		return lastErr
-	}
-	// parse obtained records
-	params, err := parseIscsiadmShow(string(out))
+	params, err := b.iscsiadm.ShowIface(b.Iface)
 	if err != nil {
-		lastErr = fmt.Errorf("iscsi: failed to parse iface records: %s (%v)", string(out), err)
+		lastErr = fmt.Errorf("iscsi: failed to show iface records: %v", err)
 		return lastErr
 	}
 	// update initiatorname
 	params["iface.initiatorname"] = b.InitiatorName
 	// create new iface
-	out, err = b.exec.Run("iscsiadm", "-m", "iface", "-I", newIface, "-o", "new")
+	err = b.iscsiadm.CreateIface(newIface)
 	if err != nil {
-		lastErr = fmt.Errorf("iscsi: failed to create new iface: %s (%v)", string(out), err)
+		lastErr = fmt.Errorf("iscsi: failed to create new iface: %v", err)
 		return lastErr
 	}
 	// update new iface records
 	for key, val := range params {
-		_, err = b.exec.Run("iscsiadm", "-m", "iface", "-I", newIface, "-o", "update", "-n", key, "-v", val)
+		// iscsi_ifacename is immutable once the iface is created
+		if val == "" || key == "iface.iscsi_ifacename" {
+			continue
+		}
+		err = b.iscsiadm.UpdateIface(newIface, key, val)
 		if err != nil {
-			b.exec.Run("iscsiadm", "-m", "iface", "-I", newIface, "-o", "delete")
-			lastErr = fmt.Errorf("iscsi: failed to update iface records: %s (%v). iface(%s) will be used", string(out), err, b.Iface)
+			b.iscsiadm.DeleteIface(newIface)
+			lastErr = fmt.Errorf("iscsi: failed to update iface records: %v. iface(%s) will be used", err, b.Iface)
 			break
 		}
 	}
@@ -0,0 +1,192 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iscsi
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// ISCSIAdm manages the iSCSI initiator of the node, i.e. the records of
+// open-iscsi and the sessions to targets. Portals are given as address:port,
+// see iscsiadm(8) for the keys of the records.
+type ISCSIAdm interface {
+	// ShowIface returns the settings of an iface record. Settings without
+	// a value are returned as "".
+	ShowIface(iface string) (map[string]string, error)
+	CreateIface(iface string) error
+	UpdateIface(iface, key, value string) error
+	DeleteIface(iface string) error
+
+	// CreateDiscovery creates the sendtargets discovery record of portal.
+	CreateDiscovery(portal, iface string) error
+	UpdateDiscovery(portal, iface, key, value string) error
+	// Discover discovers the targets of portal and creates their node
+	// records.
+	Discover(portal, iface string) error
+	DeleteDiscovery(portal, iface string) error
+
+	UpdateNode(portal, iqn, iface, key, value string) error
+	DeleteNode(portal, iqn, iface string) error
+	// Login logs in to the target of a node record.
+	Login(portal, iqn, iface string) error
+	// Logout logs out of the sessions to a target through iface, or through
+	// all ifaces if iface is "".
+	Logout(portal, iqn, iface string) error
+	// Rescan rescans the sessions to a target for new LUNs.
+	Rescan(portal, iqn string) error
+	ListSessions() ([]ISCSISession, error)
+}
+
+// ISCSISession is a session to a target.
+type ISCSISession struct {
+	Transport string
+	SID       int
+	Portal    string
+	Iqn       string
+}
+
+// iscsiadm implements ISCSIAdm with the iscsiadm command.
+type iscsiadm struct {
+	exec mount.Exec
+}
+
+// NewISCSIAdm returns an ISCSIAdm running iscsiadm with exec.
+func NewISCSIAdm(exec mount.Exec) ISCSIAdm {
+	return &iscsiadm{exec: exec}
+}
+
+var sessionRe = regexp.MustCompile(`^(\S+): \[(\d+)\] (\S+),\d+ (\S+)`)
+
+func (a *iscsiadm) run(args ...string) error {
+	out, err := a.exec.Run("iscsiadm", args...)
+	if err != nil {
+		return fmt.Errorf("%s (%v)", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+func (a *iscsiadm) ShowIface(iface string) (map[string]string, error) {
+	out, err := a.exec.Run("iscsiadm", "-m", "iface", "-I", iface, "-o", "show")
+	if err != nil {
+		return nil, fmt.Errorf("%s (%v)", strings.TrimSpace(string(out)), err)
+	}
+	return parseIscsiadmShow(string(out))
+}
+
+func (a *iscsiadm) CreateIface(iface string) error {
+	return a.run("-m", "iface", "-I", iface, "-o", "new")
+}
+
+func (a *iscsiadm) UpdateIface(iface, key, value string) error {
+	return a.run("-m", "iface", "-I", iface, "-o", "update", "-n", key, "-v", value)
+}
+
+func (a *iscsiadm) DeleteIface(iface string) error {
+	return a.run("-m", "iface", "-I", iface, "-o", "delete")
+}
+
+func (a *iscsiadm) CreateDiscovery(portal, iface string) error {
+	return a.run("-m", "discoverydb", "-t", "sendtargets", "-p", portal, "-I", iface, "-o", "new")
+}
+
+func (a *iscsiadm) UpdateDiscovery(portal, iface, key, value string) error {
+	return a.run("-m", "discoverydb", "-t", "sendtargets", "-p", portal, "-I", iface, "-o", "update", "-n", key, "-v", value)
+}
+
+func (a *iscsiadm) Discover(portal, iface string) error {
+	return a.run("-m", "discoverydb", "-t", "sendtargets", "-p", portal, "-I", iface, "--discover")
+}
+
+func (a *iscsiadm) DeleteDiscovery(portal, iface string) error {
+	return a.run("-m", "discoverydb", "-t", "sendtargets", "-p", portal, "-I", iface, "-o", "delete")
+}
+
+func (a *iscsiadm) UpdateNode(portal, iqn, iface, key, value string) error {
+	return a.run("-m", "node", "-p", portal, "-T", iqn, "-I", iface, "-o", "update", "-n", key, "-v", value)
+}
+
+func (a *iscsiadm) DeleteNode(portal, iqn, iface string) error {
+	return a.run("-m", "node", "-p", portal, "-T", iqn, "-I", iface, "-o", "delete")
+}
+
+func (a *iscsiadm) Login(portal, iqn, iface string) error {
+	return a.run("-m", "node", "-p", portal, "-T", iqn, "-I", iface, "--login")
+}
+
+func (a *iscsiadm) Logout(portal, iqn, iface string) error {
+	args := []string{"-m", "node", "-p", portal, "-T", iqn, "--logout"}
+	if iface != "" {
+		args = append(args, "-I", iface)
+	}
+	return a.run(args...)
+}
+
+func (a *iscsiadm) Rescan(portal, iqn string) error {
+	return a.run("-m", "node", "-p", portal, "-T", iqn, "-R")
+}
+
+func (a *iscsiadm) ListSessions() ([]ISCSISession, error) {
+	out, err := a.exec.Run("iscsiadm", "-m", "session")
+	if err != nil {
+		// iscsiadm fails if there is no session
+		if strings.Contains(string(out), "No active sessions") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s (%v)", strings.TrimSpace(string(out)), err)
+	}
+	return parseSessions(string(out)), nil
+}
+
+// parseSessions parses the output of iscsiadm -m session, lines like
+// "tcp: [1] 10.0.0.1:3260,1 iqn.2018-01.io.k8s:target (non-flash)".
+func parseSessions(output string) []ISCSISession {
+	var sessions []ISCSISession
+	for _, line := range strings.Split(output, "\n") {
+		m := sessionRe.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		sid, _ := strconv.Atoi(m[2])
+		sessions = append(sessions, ISCSISession{Transport: m[1], SID: sid, Portal: m[3], Iqn: m[4]})
+	}
+	return sessions
+}
+
+// parseIscsiadmShow parses the output of iscsiadm -m iface -o show.
+func parseIscsiadmShow(output string) (map[string]string, error) {
+	params := make(map[string]string)
+	slice := strings.Split(output, "\n")
+	for _, line := range slice {
+		if !strings.HasPrefix(line, "iface.") {
+			continue
+		}
+		iface := strings.Fields(line)
+		if len(iface) != 3 || iface[1] != "=" {
+			return nil, fmt.Errorf("Error: invalid iface setting: %v", iface)
+		}
+		if iface[2] == "<empty>" {
+			iface[2] = ""
+		}
+		params[iface[0]] = iface[2]
+	}
+	return params, nil
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iscsi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIscsiadmShow(t *testing.T) {
+	output := `# BEGIN RECORD 2.0-874
+iface.iscsi_ifacename = default
+iface.net_ifacename = <empty>
+iface.transport_name = tcp
+iface.initiatorname = <empty>
+# END RECORD
+`
+	params, err := parseIscsiadmShow(output)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"iface.iscsi_ifacename": "default",
+		"iface.net_ifacename":   "",
+		"iface.transport_name":  "tcp",
+		"iface.initiatorname":   "",
+	}, params)
+	assert.Equal(t, "tcp", extractTransportname(params))
+
+	// Test that an unset transport defaults to tcp
+	params["iface.transport_name"] = ""
+	assert.Equal(t, "tcp", extractTransportname(params))
+	delete(params, "iface.transport_name")
+	assert.Equal(t, "", extractTransportname(params))
+
+	_, err = parseIscsiadmShow("iface.transport_name tcp\n")
+	assert.Error(t, err)
+}
+
+func TestParseSessions(t *testing.T) {
+	output := `tcp: [1] 10.0.0.1:3260,1 iqn.2018-01.io.k8s:target (non-flash)
+tcp: [12] [fd00::1]:3260,1 iqn.2018-01.io.k8s:other (non-flash)
+`
+	assert.Equal(t, []ISCSISession{
+		{Transport: "tcp", SID: 1, Portal: "10.0.0.1:3260", Iqn: "iqn.2018-01.io.k8s:target"},
+		{Transport: "tcp", SID: 12, Portal: "[fd00::1]:3260", Iqn: "iqn.2018-01.io.k8s:other"},
+	}, parseSessions(output))
+	assert.Nil(t, parseSessions(""))
+}
+
+func TestISCSIAdmCommands(t *testing.T) {
+	exec := &fakeExec{}
+	a := NewISCSIAdm(exec)
+
+	assert.NoError(t, a.Login("10.0.0.1:3260", "iqn.2018-01.io.k8s:target", "default"))
+	assert.NoError(t, a.Logout("10.0.0.1:3260", "iqn.2018-01.io.k8s:target", ""))
+	assert.NoError(t, a.UpdateNode("10.0.0.1:3260", "iqn.2018-01.io.k8s:target", "default", "node.session.auth.authmethod", "CHAP"))
+	assert.Equal(t, []string{
+		"iscsiadm -m node -p 10.0.0.1:3260 -T iqn.2018-01.io.k8s:target -I default --login",
+		"iscsiadm -m node -p 10.0.0.1:3260 -T iqn.2018-01.io.k8s:target --logout",
+		"iscsiadm -m node -p 10.0.0.1:3260 -T iqn.2018-01.io.k8s:target -I default -o update -n node.session.auth.authmethod -v CHAP",
+	}, exec.commands)
+}
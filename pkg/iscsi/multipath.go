@@ -0,0 +1,170 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iscsi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/kubernetes/pkg/volume/util"
+)
+
+const (
+	// multipathWaitTimeout bounds how long AttachDisk waits for all paths
+	// of a disk to join its multipath device
+	multipathWaitTimeout  = 10 * time.Second
+	multipathPollInterval = time.Second
+)
+
+// multipathManager manages the multipath device of a disk which is logged in
+// through several portals. It waits for the paths of the disk to join the
+// device on attach, and flushes the device and deletes the SCSI devices of
+// the paths on detach so that no stale maps are left behind.
+type multipathManager struct {
+	deviceUtil util.DeviceUtil
+	exec       mount.Exec
+	// sysBlock is the sysfs directory of the block devices, /sys/block
+	sysBlock string
+	// resolve returns the device a /dev/disk/by-path link points at
+	resolve      func(path string) (string, error)
+	waitTimeout  time.Duration
+	pollInterval time.Duration
+}
+
+func newMultipathManager(deviceUtil util.DeviceUtil, exec mount.Exec) *multipathManager {
+	return &multipathManager{
+		deviceUtil:   deviceUtil,
+		exec:         exec,
+		sysBlock:     "/sys/block",
+		resolve:      filepath.EvalSymlinks,
+		waitTimeout:  multipathWaitTimeout,
+		pollInterval: multipathPollInterval,
+	}
+}
+
+// waitForPaths returns the multipath device of the disk with devicePaths, or
+// "" if the disk has none. It waits until all paths joined the device and
+// logs a degraded device if some do not in time. A single path is not
+// waited for unless require is set, require fails if there is no multipath
+// device.
+func (m *multipathManager) waitForPaths(devicePaths []string, require bool) (string, error) {
+	var disks []string
+	for _, path := range devicePaths {
+		disk, err := m.resolve(path)
+		if err != nil {
+			glog.Warningf("iscsi: failed to resolve %s: %v", path, err)
+			continue
+		}
+		disks = append(disks, disk)
+	}
+
+	deadline := time.Now().Add(m.waitTimeout)
+	for {
+		dm := ""
+		for _, path := range devicePaths {
+			if dm = m.deviceUtil.FindMultipathDeviceForDevice(path); dm != "" {
+				break
+			}
+		}
+		if dm != "" {
+			missing := missingPaths(disks, m.deviceUtil.FindSlaveDevicesOnMultipath(dm))
+			if len(missing) == 0 {
+				glog.V(4).Infof("iscsi: all %d paths joined multipath device %s", len(disks), dm)
+				return dm, nil
+			}
+			if time.Now().After(deadline) {
+				glog.Warningf("iscsi: multipath device %s is degraded, paths %v did not join it", dm, missing)
+				return dm, nil
+			}
+		} else if (len(devicePaths) < 2 && !require) || time.Now().After(deadline) {
+			if require {
+				return "", fmt.Errorf("iscsi: no multipath device found for %v", devicePaths)
+			}
+			if len(devicePaths) > 1 {
+				glog.Warningf("iscsi: no multipath device found for %v, using a single path", devicePaths)
+			}
+			return "", nil
+		}
+		time.Sleep(m.pollInterval)
+	}
+}
+
+// detach flushes the multipath device devicePath, if it is one, and deletes
+// the SCSI devices of its paths, or of devicePath itself.
+func (m *multipathManager) detach(devicePath string) error {
+	if devicePath == "" {
+		return nil
+	}
+	var devices []string
+	if isMultipathDevice(devicePath) {
+		devices = m.deviceUtil.FindSlaveDevicesOnMultipath(devicePath)
+		glog.Infof("iscsi: flush multipath device %s of paths %v", devicePath, devices)
+		if out, err := m.exec.Run("multipath", "-f", devicePath); err != nil {
+			return fmt.Errorf("iscsi: failed to flush multipath device %s: %s (%v)", devicePath, string(out), err)
+		}
+	} else {
+		disk, err := m.resolve(devicePath)
+		if err != nil {
+			glog.Warningf("iscsi: failed to resolve %s: %v", devicePath, err)
+			return nil
+		}
+		devices = []string{disk}
+	}
+	for _, device := range devices {
+		m.deleteSCSIDevice(device)
+	}
+	return nil
+}
+
+// deleteSCSIDevice removes a SCSI device from the kernel before logging out,
+// so that I/O to it is not retried until the session times out.
+func (m *multipathManager) deleteSCSIDevice(device string) {
+	name := filepath.Base(device)
+	if !strings.HasPrefix(name, "sd") {
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(m.sysBlock, name, "device", "delete"), []byte("1"), 0200); err != nil {
+		glog.Warningf("iscsi: failed to delete SCSI device %s: %v", device, err)
+	}
+}
+
+func isMultipathDevice(device string) bool {
+	return strings.HasPrefix(filepath.Base(device), "dm-")
+}
+
+// missingPaths returns the disks which are not among joined.
+func missingPaths(disks, joined []string) []string {
+	var missing []string
+	for _, disk := range disks {
+		found := false
+		for _, j := range joined {
+			if filepath.Base(j) == filepath.Base(disk) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, disk)
+		}
+	}
+	return missing
+}
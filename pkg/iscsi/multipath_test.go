@@ -0,0 +1,155 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iscsi
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDeviceUtil maps by-path links to disks and disks to multipath devices
+type fakeDeviceUtil struct {
+	disks  map[string]string
+	slaves map[string][]string
+}
+
+func (f *fakeDeviceUtil) FindMultipathDeviceForDevice(device string) string {
+	disk := f.disks[device]
+	for dm, slaves := range f.slaves {
+		for _, slave := range slaves {
+			if slave == disk {
+				return dm
+			}
+		}
+	}
+	return ""
+}
+
+func (f *fakeDeviceUtil) FindSlaveDevicesOnMultipath(dm string) []string {
+	return f.slaves[dm]
+}
+
+func (f *fakeDeviceUtil) GetISCSIPortalHostMapForTarget(targetIqn string) (map[string]int, error) {
+	return nil, nil
+}
+
+func (f *fakeDeviceUtil) FindDevicesForISCSILun(targetIqn string, lun int) ([]string, error) {
+	return nil, nil
+}
+
+// fakeExec records the commands it runs
+type fakeExec struct {
+	commands []string
+	err      error
+}
+
+func (f *fakeExec) Run(cmd string, args ...string) ([]byte, error) {
+	f.commands = append(f.commands, strings.Join(append([]string{cmd}, args...), " "))
+	return nil, f.err
+}
+
+func newFakeMultipathManager(deviceUtil *fakeDeviceUtil, exec *fakeExec) *multipathManager {
+	m := newMultipathManager(deviceUtil, exec)
+	m.resolve = func(path string) (string, error) {
+		if disk, ok := deviceUtil.disks[path]; ok {
+			return disk, nil
+		}
+		return "", os.ErrNotExist
+	}
+	m.waitTimeout = 50 * time.Millisecond
+	m.pollInterval = time.Millisecond
+	return m
+}
+
+func TestWaitForPaths(t *testing.T) {
+	paths := []string{"/dev/disk/by-path/ip-10.0.0.1:3260-lun-0", "/dev/disk/by-path/ip-10.0.0.2:3260-lun-0"}
+	deviceUtil := &fakeDeviceUtil{
+		disks:  map[string]string{paths[0]: "/dev/sdb", paths[1]: "/dev/sdc"},
+		slaves: map[string][]string{"/dev/dm-0": {"/dev/sdb", "/dev/sdc"}},
+	}
+	m := newFakeMultipathManager(deviceUtil, &fakeExec{})
+
+	dm, err := m.waitForPaths(paths, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/dm-0", dm)
+
+	// Test that a degraded device is used
+	deviceUtil.slaves["/dev/dm-0"] = []string{"/dev/sdb"}
+	assert.Equal(t, []string{"/dev/sdc"}, missingPaths([]string{"/dev/sdb", "/dev/sdc"}, deviceUtil.slaves["/dev/dm-0"]))
+	dm, err = m.waitForPaths(paths, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/dm-0", dm)
+
+	// Test disks without a multipath device
+	deviceUtil.slaves = map[string][]string{}
+	dm, err = m.waitForPaths(paths, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "", dm)
+	_, err = m.waitForPaths(paths, true)
+	assert.Error(t, err)
+
+	// Test that a single path is not waited for
+	m.waitTimeout = time.Hour
+	dm, err = m.waitForPaths(paths[:1], false)
+	assert.NoError(t, err)
+	assert.Equal(t, "", dm)
+}
+
+func TestMultipathDetach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi-sysfs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, disk := range []string{"sdb", "sdc", "sdd"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, disk, "device"), 0755))
+	}
+
+	path := "/dev/disk/by-path/ip-10.0.0.1:3260-lun-0"
+	deviceUtil := &fakeDeviceUtil{
+		disks:  map[string]string{path: "/dev/sdd"},
+		slaves: map[string][]string{"/dev/dm-0": {"/dev/sdb", "/dev/sdc"}},
+	}
+	exec := &fakeExec{}
+	m := newFakeMultipathManager(deviceUtil, exec)
+	m.sysBlock = dir
+
+	// Test that the map is flushed and its paths are deleted
+	assert.NoError(t, m.detach("/dev/dm-0"))
+	assert.Equal(t, []string{"multipath -f /dev/dm-0"}, exec.commands)
+	for _, disk := range []string{"sdb", "sdc"} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, disk, "device", "delete"))
+		assert.NoError(t, err)
+		assert.Equal(t, "1", string(content))
+	}
+
+	// Test a single path
+	assert.NoError(t, m.detach(path))
+	_, err = os.Stat(filepath.Join(dir, "sdd", "device", "delete"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(exec.commands))
+
+	// Test that a failed flush fails the detach
+	exec.err = errors.New("map in use")
+	assert.Error(t, m.detach("/dev/dm-0"))
+	assert.NoError(t, m.detach(""))
+}
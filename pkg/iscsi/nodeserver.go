@@ -17,28 +17,95 @@ limitations under the License.
 package iscsi
 
 import (
+	"os"
+	"syscall"
+
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/kubernetes/pkg/volume/util"
 
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
+// nodeServer logs in to the target and mounts the disk once per node at the
+// staging path in NodeStageVolume. NodePublishVolume bind mounts the staging
+// path on each target path, so that pods sharing a LUN share one session and
+// one filesystem mount.
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	mounter   mount.Interface
+	exec      mount.Exec
+	iscsiadm  ISCSIAdm
+	multipath *multipathManager
+	byPathDir string
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	iscsiInfo, err := getISCSIInfo(req)
-	if err != nil {
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	if len(req.GetTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	// The session is logged in by NodeStageVolume, CHAP credentials given to
+	// publish would silently go unused
+	if len(req.GetNodePublishSecrets()) != 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume %s has node publish secrets, CHAP credentials must be given as node stage secrets", req.GetVolumeId())
+	}
+
+	// Raw block volumes are published from the device file in the staging
+	// path onto a file
+	block := req.GetVolumeCapability().GetBlock() != nil
+	source := req.GetStagingTargetPath()
+	if block {
+		source = stagedBlockDevice(source)
+	}
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(source)
+	if err != nil && !os.IsNotExist(err) {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	diskMounter := getISCSIDiskMounter(iscsiInfo, req)
+	if err != nil || notMnt {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is not staged at %s", req.GetVolumeId(), req.GetStagingTargetPath())
+	}
 
-	util := &ISCSIUtil{}
-	_, err = util.AttachDisk(*diskMounter)
+	targetPath := req.GetTargetPath()
+	notMnt, err = ns.mounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			if block {
+				err = makeFile(targetPath)
+			} else {
+				err = os.MkdirAll(targetPath, 0750)
+			}
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
+		} else {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if !notMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	options := []string{"bind"}
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+	if err := ns.mounter.Mount(source, targetPath, "", options); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
@@ -46,12 +113,18 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 }
 
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	diskUnmounter := getISCSIDiskUnmounter(req)
-	targetPath := req.GetTargetPath()
 
-	iscsiutil := &ISCSIUtil{}
-	err := iscsiutil.DetachDisk(*diskUnmounter, targetPath)
-	if err != nil {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+
+	// UnmountPath succeeds for missing and already unmounted targets and
+	// removes the leftover directory
+	if err := util.UnmountPath(req.GetTargetPath(), ns.mounter); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
@@ -59,9 +132,126 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 }
 
 func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	if _, err := os.Stat(stagingPath); os.IsNotExist(err) {
+		// Already unstaged
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	// Logging out while the disk is published would break the targets
+	refs, err := mount.GetMountRefs(ns.mounter, stagingPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	blockRefs, err := ns.getBlockPublishes(stagingPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	refs = append(refs, blockRefs...)
+	if len(refs) != 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is still published at %v", req.GetVolumeId(), refs)
+	}
+
+	diskUnmounter := ns.getISCSIDiskUnmounter(req)
+	iscsiutil := &ISCSIUtil{}
+	if err := iscsiutil.DetachDisk(*diskUnmounter, stagingPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+
+	iscsiInfo, err := getISCSIInfo(req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	diskMounter := ns.getISCSIDiskMounter(iscsiInfo, req)
+
+	util := &ISCSIUtil{}
+	if _, err := util.AttachDisk(*diskMounter); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	return &csi.NodeStageVolumeResponse{}, nil
 }
+
+// getBlockPublishes returns the targets the raw block disk staged at
+// stagingPath is published at. The bind mounts of a device node report the
+// devtmpfs as their device, which all device nodes share, so the mounts are
+// told apart by the device number of the mounted node.
+func (ns *nodeServer) getBlockPublishes(stagingPath string) ([]string, error) {
+	stagedDevice := stagedBlockDevice(stagingPath)
+	fi, err := os.Stat(stagedDevice)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	refs, err := mount.GetMountRefs(ns.mounter, stagedDevice)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeDevice == 0 {
+		// The node is not mounted, the references are all there is
+		return refs, nil
+	}
+	var targets []string
+	for _, ref := range refs {
+		refInfo, err := os.Stat(ref)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if refInfo.Mode()&os.ModeDevice != 0 && deviceNumber(refInfo) == deviceNumber(fi) {
+			targets = append(targets, ref)
+		}
+	}
+	return targets, nil
+}
+
+// deviceNumber returns the device number of the device node described by fi.
+func deviceNumber(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Rdev)
+	}
+	return 0
+}
+
+func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+					},
+				},
+			},
+		},
+	}, nil
+}
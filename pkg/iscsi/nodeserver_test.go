@@ -0,0 +1,315 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iscsi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+func TestPublishBindMountsStagingPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi-node")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock"))
+	mounter := csicommon.NewRecordingMounter()
+	ns.mounter = mounter
+
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+		},
+		Readonly: true,
+	}
+
+	// Test publishing a volume which is not staged
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Test that CHAP credentials are not taken from publish secrets
+	req.NodePublishSecrets = map[string]string{"node.session.auth.password": "chap"}
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	req.NodePublishSecrets = nil
+
+	assert.NoError(t, os.MkdirAll(stagingPath, 0750))
+	assert.NoError(t, mounter.Mount("/dev/sdb", stagingPath, "ext4", nil))
+	for i := 0; i < 2; i++ {
+		_, err = ns.NodePublishVolume(context.Background(), req)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, len(mounter.MountPoints))
+	assert.Equal(t, "/dev/sdb", mounter.MountPoints[1].Device)
+	assert.Equal(t, targetPath, mounter.MountPoints[1].Path)
+	assert.Equal(t, []string{"bind", "ro"}, mounter.Opts[targetPath])
+
+	// Test that unpublish is idempotent
+	for i := 0; i < 2; i++ {
+		_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: targetPath})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, len(mounter.MountPoints))
+	_, err = os.Stat(targetPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNodeGetCapabilities(t *testing.T) {
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock"))
+	resp, err := ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME, resp.GetCapabilities()[0].GetRpc().GetType())
+}
+
+func TestPublishBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi-node")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock"))
+	mounter := &mount.FakeMounter{}
+	ns.mounter = mounter
+
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		},
+	}
+
+	// Test that a mounted staging directory does not stage a block volume
+	assert.NoError(t, os.MkdirAll(stagingPath, 0750))
+	assert.NoError(t, mounter.Mount("/dev/sdb", stagingPath, "ext4", nil))
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.NoError(t, mounter.Unmount(stagingPath))
+
+	stagedDevice := stagedBlockDevice(stagingPath)
+	assert.NoError(t, makeFile(stagedDevice))
+	assert.NoError(t, mounter.Mount("/dev/sdb", stagedDevice, "", []string{"bind"}))
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+
+	// Test that the device is bind mounted on a file
+	fi, err := os.Stat(targetPath)
+	assert.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+	assert.Equal(t, 2, len(mounter.MountPoints))
+	assert.Equal(t, "/dev/sdb", mounter.MountPoints[1].Device)
+	assert.Equal(t, targetPath, mounter.MountPoints[1].Path)
+
+	// Test that unstage is refused while the device is published
+	unstage := &csi.NodeUnstageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath}
+	_, err = ns.NodeUnstageVolume(context.Background(), unstage)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, 2, len(mounter.MountPoints))
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: targetPath})
+	assert.NoError(t, err)
+	_, err = os.Stat(targetPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = ns.NodeUnstageVolume(context.Background(), unstage)
+	assert.NoError(t, err)
+	assert.Zero(t, len(mounter.MountPoints))
+}
+
+const testIqn = "iqn.2018-01.io.k8s:target"
+
+// newFakeNodeServer returns a node server attaching disks with a
+// FakeISCSIAdm, by-path files and sysfs are kept in dir
+func newFakeNodeServer(dir string, deviceUtil *fakeDeviceUtil) (*nodeServer, *FakeISCSIAdm, *mount.FakeMounter, *fakeExec) {
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock"))
+	mounter := &mount.FakeMounter{}
+	exec := &fakeExec{}
+	iscsiadm := NewFakeISCSIAdm(filepath.Join(dir, "by-path"))
+	ns.mounter = mounter
+	ns.exec = exec
+	ns.iscsiadm = iscsiadm
+	ns.byPathDir = filepath.Join(dir, "by-path")
+	ns.multipath = newFakeMultipathManager(deviceUtil, exec)
+	ns.multipath.sysBlock = filepath.Join(dir, "sys")
+	return ns, iscsiadm, mounter, exec
+}
+
+func stageRequest(stagingPath string, attributes, secrets map[string]string) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+		},
+		VolumeAttributes: attributes,
+		NodeStageSecrets: secrets,
+	}
+}
+
+func TestStageUnstage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi-node")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns, iscsiadm, mounter, _ := newFakeNodeServer(dir, &fakeDeviceUtil{})
+	iscsiadm.AddTarget(FakeTarget{Portal: "10.0.0.1:3260", Iqn: testIqn, Luns: []int{0, 1}, Username: "user", Password: "password"})
+
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+	devicePath := filepath.Join(dir, "by-path", "ip-10.0.0.1:3260-iscsi-"+testIqn+"-lun-1")
+	attributes := map[string]string{
+		"targetPortal":    "10.0.0.1",
+		"iqn":             testIqn,
+		"lun":             "1",
+		"portals":         "[]",
+		"sessionCHAPAuth": "true",
+	}
+	secrets := map[string]string{
+		"node.session.auth.username": "user",
+		"node.session.auth.password": "wrong",
+	}
+
+	// Test that a failed login leaves no session behind
+	_, err = ns.NodeStageVolume(context.Background(), stageRequest(stagingPath, attributes, secrets))
+	assert.Equal(t, codes.Internal, status.Code(err))
+	sessions, err := iscsiadm.ListSessions()
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+	_, err = os.Stat(devicePath)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test that staging twice logs in and mounts once
+	secrets["node.session.auth.password"] = "password"
+	for i := 0; i < 2; i++ {
+		_, err = ns.NodeStageVolume(context.Background(), stageRequest(stagingPath, attributes, secrets))
+		assert.NoError(t, err)
+	}
+	sessions, err = iscsiadm.ListSessions()
+	assert.NoError(t, err)
+	assert.Equal(t, []ISCSISession{{Transport: "tcp", SID: 1, Portal: "10.0.0.1:3260", Iqn: testIqn}}, sessions)
+	assert.Equal(t, 1, len(mounter.MountPoints))
+	assert.Equal(t, devicePath, mounter.MountPoints[0].Device)
+	assert.Equal(t, stagingPath, mounter.MountPoints[0].Path)
+
+	// Test that a published volume is not unstaged
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  stageRequest(stagingPath, nil, nil).VolumeCapability,
+	})
+	assert.NoError(t, err)
+	unstageReq := &csi.NodeUnstageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath}
+	_, err = ns.NodeUnstageVolume(context.Background(), unstageReq)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Test that unstaging logs out and is idempotent
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: targetPath})
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = ns.NodeUnstageVolume(context.Background(), unstageReq)
+		assert.NoError(t, err)
+	}
+	sessions, err = iscsiadm.ListSessions()
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+	assert.Empty(t, mounter.MountPoints)
+	_, err = os.Stat(devicePath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(stagingPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStageUnstageMultipath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi-node")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, disk := range []string{"sdb", "sdc"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "sys", disk, "device"), 0755))
+	}
+
+	paths := []string{
+		filepath.Join(dir, "by-path", "ip-10.0.0.1:3260-iscsi-"+testIqn+"-lun-0"),
+		filepath.Join(dir, "by-path", "ip-10.0.0.2:3260-iscsi-"+testIqn+"-lun-0"),
+	}
+	deviceUtil := &fakeDeviceUtil{
+		disks:  map[string]string{paths[0]: "/dev/sdb", paths[1]: "/dev/sdc"},
+		slaves: map[string][]string{"/dev/dm-0": {"/dev/sdb", "/dev/sdc"}},
+	}
+	ns, iscsiadm, mounter, exec := newFakeNodeServer(dir, deviceUtil)
+	// The second portal is down
+	iscsiadm.AddTarget(FakeTarget{Portal: "10.0.0.1:3260", Iqn: testIqn, Luns: []int{0}})
+
+	stagingPath := filepath.Join(dir, "staging")
+	attributes := map[string]string{
+		"targetPortal":  "10.0.0.1",
+		"iqn":           testIqn,
+		"lun":           "0",
+		"portals":       `["10.0.0.2"]`,
+		"initiatorName": "iqn.2018-01.io.k8s:node",
+	}
+	iface := "10.0.0.1:3260:vol"
+
+	// Test that the disk is attached through the reachable portal
+	_, err = ns.NodeStageVolume(context.Background(), stageRequest(stagingPath, attributes, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/dm-0", mounter.MountPoints[0].Device)
+	params, err := iscsiadm.ShowIface(iface)
+	assert.NoError(t, err)
+	assert.Equal(t, "iqn.2018-01.io.k8s:node", params["iface.initiatorname"])
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath})
+	assert.NoError(t, err)
+
+	// Test that all paths are logged in and the map is flushed on unstage
+	iscsiadm.AddTarget(FakeTarget{Portal: "10.0.0.2:3260", Iqn: testIqn, Luns: []int{0}})
+	_, err = ns.NodeStageVolume(context.Background(), stageRequest(stagingPath, attributes, nil))
+	assert.NoError(t, err)
+	sessions, err := iscsiadm.ListSessions()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(sessions))
+	assert.Equal(t, "/dev/dm-0", mounter.MountPoints[0].Device)
+
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath})
+	assert.NoError(t, err)
+	assert.Contains(t, exec.commands, "multipath -f /dev/dm-0")
+	for _, disk := range []string{"sdb", "sdc"} {
+		_, err = os.Stat(filepath.Join(dir, "sys", disk, "device", "delete"))
+		assert.NoError(t, err)
+	}
+	sessions, err = iscsiadm.ListSessions()
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+	_, err = iscsiadm.ShowIface(iface)
+	assert.Error(t, err)
+}
@@ -0,0 +1,418 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+// StorageClass parameters and volume attributes
+const (
+	paramServer  = "server"
+	paramShare   = "share"
+	paramReclaim = "reclaim"
+
+	// reclaimDelete removes the volume directory in DeleteVolume
+	reclaimDelete = "delete"
+	// reclaimArchive renames the volume directory to archivedPrefix + name
+	reclaimArchive = "archive"
+	archivedPrefix = "archived-"
+
+	// idSeparator separates the fields of a volume ID, it cannot appear in
+	// a server name, an export path or a volume name
+	idSeparator = "#"
+	// maxVolumeIDLength is the longest volume ID CSI allows
+	maxVolumeIDLength = 128
+
+	// metadataDir is the directory of the base export holding the reclaim
+	// policy and mount attributes of each volume, they do not fit in the
+	// volume ID
+	metadataDir = ".csi-nfs"
+)
+
+// controllerServer provisions volumes as subdirectories of a base export.
+// The base export is mounted in a working directory of the volume for the
+// duration of each CreateVolume and DeleteVolume call, concurrent calls for
+// the same volume fail with Aborted.
+type controllerServer struct {
+	*csicommon.DefaultControllerServer
+	// workingMountDir holds the temporary mounts of base exports
+	workingMountDir string
+	mounter         mount.Interface
+	// dial checks that a server is reachable
+	dial func(server string) error
+
+	mu sync.Mutex
+	// inflight holds the names of the volumes being created or deleted
+	inflight map[string]bool
+}
+
+// nfsVolume is a provisioned volume. server is a comma separated list of
+// servers exporting the same share, attributes the mount attributes the node
+// mounts the volume with. Only server, share and name are encoded in the
+// volume ID, reclaim and attributes are kept in the metadata of the volume.
+type nfsVolume struct {
+	server     string
+	share      string
+	name       string
+	reclaim    string
+	attributes map[string]string
+}
+
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		glog.V(3).Infof("invalid create volume req: %v", req)
+		return nil, err
+	}
+
+	// Check arguments
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if req.GetVolumeCapabilities() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
+	}
+	for _, cap := range req.GetVolumeCapabilities() {
+		if cap.GetBlock() != nil {
+			return nil, status.Error(codes.InvalidArgument, "Block access is not supported")
+		}
+	}
+	vol, err := newNFSVolume(req.GetName(), req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(vol.id()) > maxVolumeIDLength {
+		return nil, status.Errorf(codes.InvalidArgument, "volume ID %q is longer than %d bytes", vol.id(), maxVolumeIDLength)
+	}
+	// The node mounts the volume with the same mount attributes as the base
+	// export
+	attributes := map[string]string{
+		paramServer: vol.server,
+		paramShare:  path.Join(vol.share, vol.name),
+	}
+	for attr, v := range vol.attributes {
+		attributes[attr] = v
+	}
+
+	if !cs.tryLock(vol.name) {
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", vol.name)
+	}
+	defer cs.unlock(vol.name)
+
+	dir, err := cs.mountShare(vol)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer cs.unmountShare(dir)
+
+	volPath := filepath.Join(dir, vol.name)
+	glog.V(4).Infof("nfs: creating volume directory %s on %s:%s", vol.name, vol.server, vol.share)
+	if err := os.MkdirAll(volPath, 0777); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	// Let pods running as any user write to the volume regardless of umask
+	if err := os.Chmod(volPath, 0777); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := writeMetadata(dir, vol); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			Id:            vol.id(),
+			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+			Attributes:    attributes,
+		},
+	}, nil
+}
+
+func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		glog.V(3).Infof("invalid delete volume req: %v", req)
+		return nil, err
+	}
+	vol, err := parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if !cs.tryLock(vol.name) {
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", vol.name)
+	}
+	defer cs.unlock(vol.name)
+
+	dir, err := cs.mountShare(vol)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer cs.unmountShare(dir)
+
+	volPath := filepath.Join(dir, vol.name)
+	if _, err := os.Stat(volPath); os.IsNotExist(err) {
+		if err := removeMetadata(dir, vol.name); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	if err := readMetadata(dir, vol); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if vol.reclaim == reclaimArchive {
+		archivePath, err := archivePath(dir, vol.name)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.V(4).Infof("nfs: archiving volume directory %s on %s:%s as %s", vol.name, vol.server, vol.share, filepath.Base(archivePath))
+		if err := os.Rename(volPath, archivePath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		glog.V(4).Infof("nfs: removing volume directory %s on %s:%s", vol.name, vol.server, vol.share)
+		if err := os.RemoveAll(volPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := removeMetadata(dir, vol.name); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// volumeMetadata is the part of an nfsVolume that is not encoded in its ID.
+type volumeMetadata struct {
+	Reclaim    string            `json:"reclaim"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func metadataPath(dir, name string) string {
+	return filepath.Join(dir, metadataDir, name+".json")
+}
+
+// writeMetadata stores the reclaim policy and mount attributes of vol in the
+// base export mounted at dir.
+func writeMetadata(dir string, vol *nfsVolume) error {
+	data, err := json.Marshal(volumeMetadata{Reclaim: vol.reclaim, Attributes: vol.attributes})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, metadataDir), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(metadataPath(dir, vol.name), data, 0600)
+}
+
+// readMetadata sets the reclaim policy and mount attributes of vol from the
+// base export mounted at dir. A volume without metadata is archived rather
+// than removed.
+func readMetadata(dir string, vol *nfsVolume) error {
+	data, err := ioutil.ReadFile(metadataPath(dir, vol.name))
+	if os.IsNotExist(err) {
+		glog.Warningf("nfs: volume %s has no metadata, archiving it", vol.name)
+		vol.reclaim = reclaimArchive
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var meta volumeMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("invalid metadata of volume %s: %v", vol.name, err)
+	}
+	vol.reclaim = meta.Reclaim
+	vol.attributes = meta.Attributes
+	return nil
+}
+
+func removeMetadata(dir, name string) error {
+	if err := os.Remove(metadataPath(dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// archivePath returns a path in dir to archive the volume directory name at,
+// archivedPrefix + name or, if that exists from an earlier volume of the same
+// name, archivedPrefix + name + "-<n>".
+func archivePath(dir, name string) (string, error) {
+	for n := 0; ; n++ {
+		archiveName := archivedPrefix + name
+		if n > 0 {
+			archiveName += fmt.Sprintf("-%d", n)
+		}
+		archivePath := filepath.Join(dir, archiveName)
+		if _, err := os.Lstat(archivePath); err != nil {
+			if os.IsNotExist(err) {
+				return archivePath, nil
+			}
+			return "", err
+		}
+	}
+}
+
+// tryLock marks the volume name as in flight. It returns false if it already
+// is.
+func (cs *controllerServer) tryLock(name string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.inflight[name] {
+		return false
+	}
+	cs.inflight[name] = true
+	return true
+}
+
+// unlock releases the volume name marked by tryLock.
+func (cs *controllerServer) unlock(name string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.inflight, name)
+}
+
+// mountShare mounts the base export of vol in a working directory of its own
+// with the mount attributes of vol and returns the directory.
+func (cs *controllerServer) mountShare(vol *nfsVolume) (string, error) {
+	dir := filepath.Join(cs.workingMountDir, vol.name)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	notMnt, err := cs.mounter.IsLikelyNotMountPoint(dir)
+	if err != nil {
+		return "", err
+	}
+	if !notMnt {
+		return dir, nil
+	}
+	fsType, options, err := buildMountOptions(vol.attributes, nil, false)
+	if err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	servers, err := parseServers(vol.server)
+	if err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	server, err := selectServer(servers, cs.dial)
+	if err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	source := mountSource(server, vol.share)
+	if err := cs.mounter.Mount(source, dir, fsType, options); err != nil {
+		os.Remove(dir)
+		return "", fmt.Errorf("nfs: failed to mount %s: %v", source, err)
+	}
+	return dir, nil
+}
+
+// unmountShare unmounts and removes a working directory of mountShare.
+func (cs *controllerServer) unmountShare(dir string) {
+	if err := cs.mounter.Unmount(dir); err != nil {
+		glog.Errorf("nfs: failed to unmount %s: %v", dir, err)
+		return
+	}
+	if err := os.Remove(dir); err != nil {
+		glog.Errorf("nfs: failed to remove %s: %v", dir, err)
+	}
+}
+
+func newNFSVolume(name string, params map[string]string) (*nfsVolume, error) {
+	vol := &nfsVolume{
+		server:  params[paramServer],
+		share:   params[paramShare],
+		name:    name,
+		reclaim: params[paramReclaim],
+	}
+	if vol.server == "" || vol.share == "" {
+		return nil, fmt.Errorf("parameters %q and %q are required", paramServer, paramShare)
+	}
+	servers, err := parseServers(vol.server)
+	if err != nil {
+		return nil, err
+	}
+	vol.server = strings.Join(servers, ",")
+	if !path.IsAbs(vol.share) {
+		return nil, fmt.Errorf("share %q must be an absolute path", vol.share)
+	}
+	vol.share = path.Clean(vol.share)
+	if strings.ContainsAny(name, "/"+idSeparator) || name == "." || name == ".." || name == metadataDir {
+		return nil, fmt.Errorf("invalid volume name %q", name)
+	}
+	if strings.Contains(vol.server+vol.share, idSeparator) {
+		return nil, fmt.Errorf("server and share must not contain %q", idSeparator)
+	}
+	switch vol.reclaim {
+	case "":
+		vol.reclaim = reclaimDelete
+	case reclaimDelete, reclaimArchive:
+	default:
+		return nil, fmt.Errorf("invalid %s %q, expected %q or %q", paramReclaim, vol.reclaim, reclaimDelete, reclaimArchive)
+	}
+	for _, attr := range mountAttributes {
+		if v, ok := params[attr]; ok {
+			if vol.attributes == nil {
+				vol.attributes = map[string]string{}
+			}
+			vol.attributes[attr] = v
+		}
+	}
+	if _, _, err := buildMountOptions(vol.attributes, nil, false); err != nil {
+		return nil, err
+	}
+	return vol, nil
+}
+
+// id encodes vol as server#share#name.
+func (vol *nfsVolume) id() string {
+	return strings.Join([]string{vol.server, vol.share, vol.name}, idSeparator)
+}
+
+// parseVolumeID returns the volume of id with the default reclaim policy and
+// no mount attributes, readMetadata sets them.
+func parseVolumeID(id string) (*nfsVolume, error) {
+	fields := strings.Split(id, idSeparator)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid volume id %q", id)
+	}
+	return newNFSVolume(fields[2], map[string]string{
+		paramServer: fields[0],
+		paramShare:  fields[1],
+	})
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+func newFakeControllerServer(t *testing.T) (*controllerServer, *csicommon.RecordingMounter, string) {
+	dir, err := ioutil.TempDir("", "nfs-controller")
+	assert.NoError(t, err)
+	d := NewDriver("node", "unix://tmp/csi.sock", dir, filepath.Join(dir, "state"), filepath.Join(dir, "krb5"), 0)
+	cs := NewControllerServer(d)
+	mounter := csicommon.NewRecordingMounter()
+	cs.mounter = mounter
+	return cs, mounter, dir
+}
+
+func TestVolumeID(t *testing.T) {
+	vol, err := newNFSVolume("pvc-1", map[string]string{paramServer: "10.0.0.1", paramShare: "/export/"})
+	assert.NoError(t, err)
+	assert.Equal(t, reclaimDelete, vol.reclaim)
+	assert.Equal(t, "10.0.0.1#/export#pvc-1", vol.id())
+
+	parsed, err := parseVolumeID(vol.id())
+	assert.NoError(t, err)
+	assert.Equal(t, vol, parsed)
+
+	_, err = parseVolumeID("data-id")
+	assert.Error(t, err)
+
+	// Test that server lists are stored comma separated
+	vol, err = newNFSVolume("pvc-1", map[string]string{paramServer: `["10.0.0.1", "10.0.0.2"]`, paramShare: "/export"})
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1,10.0.0.2#/export#pvc-1", vol.id())
+
+	// Test that the reclaim policy and mount attributes are not part of the
+	// ID
+	vol, err = newNFSVolume("pvc-1", map[string]string{paramServer: "10.0.0.1", paramShare: "/export", paramReclaim: reclaimArchive, attrSec: "krb5", attrNFSVersion: "4.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1#/export#pvc-1", vol.id())
+
+	_, err = parseVolumeID("10.0.0.1#/export#pvc-1#delete")
+	assert.Error(t, err)
+	_, err = parseVolumeID("10.0.0.1#export#pvc-1")
+	assert.Error(t, err)
+}
+
+func TestNewNFSVolumeInvalid(t *testing.T) {
+	params := map[string]string{paramServer: "10.0.0.1", paramShare: "/export"}
+	_, err := newNFSVolume("../pvc", params)
+	assert.Error(t, err)
+	_, err = newNFSVolume("pvc", map[string]string{paramServer: "10.0.0.1"})
+	assert.Error(t, err)
+	_, err = newNFSVolume("pvc", map[string]string{paramServer: "10.0.0.1", paramShare: "export"})
+	assert.Error(t, err)
+	_, err = newNFSVolume("pvc", map[string]string{paramServer: "10.0.0.1", paramShare: "/export", paramReclaim: "retain"})
+	assert.Error(t, err)
+	_, err = newNFSVolume(metadataDir, params)
+	assert.Error(t, err)
+}
+
+func TestCreateVolumeLongID(t *testing.T) {
+	cs, _, dir := newFakeControllerServer(t)
+	defer os.RemoveAll(dir)
+
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: strings.Repeat("a", maxVolumeIDLength),
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		}},
+		Parameters: map[string]string{paramServer: "10.0.0.1", paramShare: "/export"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestDeleteVolumeInvalidID(t *testing.T) {
+	cs, mounter, dir := newFakeControllerServer(t)
+	defer os.RemoveAll(dir)
+
+	_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "data-id"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Empty(t, mounter.Log)
+}
+
+func TestCreateDeleteVolume(t *testing.T) {
+	for _, reclaim := range []string{reclaimDelete, reclaimArchive} {
+		cs, mounter, dir := newFakeControllerServer(t)
+		defer os.RemoveAll(dir)
+
+		resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name: "pvc-1",
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			}},
+			Parameters: map[string]string{paramServer: "10.0.0.1", paramShare: "/export", paramReclaim: reclaim},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "/export/pvc-1", resp.GetVolume().GetAttributes()[paramShare])
+		assert.Equal(t, "10.0.0.1", resp.GetVolume().GetAttributes()[paramServer])
+		assert.Equal(t, "10.0.0.1:/export", mounter.Log[0].Source)
+		assert.Zero(t, len(mounter.MountPoints))
+
+		// Nothing is really mounted, so the volume directory is created in
+		// the working directory itself
+		workDir := filepath.Join(dir, "pvc-1")
+		fi, err := os.Stat(filepath.Join(workDir, "pvc-1"))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0777), fi.Mode().Perm())
+
+		_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetId()})
+		assert.NoError(t, err)
+		_, err = os.Stat(filepath.Join(workDir, "pvc-1"))
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(workDir, archivedPrefix+"pvc-1"))
+		assert.Equal(t, reclaim == reclaimArchive, err == nil)
+		_, err = os.Stat(metadataPath(workDir, "pvc-1"))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestDeleteVolumeWithoutMetadata(t *testing.T) {
+	cs, _, dir := newFakeControllerServer(t)
+	defer os.RemoveAll(dir)
+
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		}},
+		Parameters: map[string]string{paramServer: "10.0.0.1", paramShare: "/export"},
+	})
+	assert.NoError(t, err)
+
+	// Test that a volume whose reclaim policy is lost is archived
+	workDir := filepath.Join(dir, "pvc-1")
+	assert.NoError(t, os.Remove(metadataPath(workDir, "pvc-1")))
+	_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetId()})
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(workDir, archivedPrefix+"pvc-1"))
+	assert.NoError(t, err)
+}
+
+func TestCreateVolumeMountOptions(t *testing.T) {
+	cs, mounter, dir := newFakeControllerServer(t)
+	defer os.RemoveAll(dir)
+
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		}},
+		Parameters: map[string]string{paramServer: "10.0.0.1", paramShare: "/export", attrNFSVersion: "4.1", attrProto: "tcp"},
+	}
+	resp, err := cs.CreateVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "nfs4", mounter.Log[0].FSType)
+	workDir := filepath.Join(dir, "pvc-1")
+	assert.Equal(t, []string{"vers=4.1", "proto=tcp"}, mounter.Opts[workDir])
+	assert.Equal(t, "tcp", resp.GetVolume().GetAttributes()[attrProto])
+
+	// Test that the mount attributes are kept in the metadata of the volume
+	vol, err := parseVolumeID(resp.GetVolume().GetId())
+	assert.NoError(t, err)
+	assert.NoError(t, readMetadata(workDir, vol))
+	assert.Equal(t, map[string]string{attrNFSVersion: "4.1", attrProto: "tcp"}, vol.attributes)
+
+	// Test that the base export is mounted with negotiated options for
+	// deletion
+	delete(mounter.Opts, workDir)
+	_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetId()})
+	assert.NoError(t, err)
+	assert.Empty(t, mounter.Opts[workDir])
+
+	// Test invalid mount attributes
+	req.Parameters[attrProto] = "udp"
+	_, err = cs.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Test that a concurrent operation on the volume is aborted
+	assert.True(t, cs.tryLock("pvc-1"))
+	_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetId()})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	cs.unlock("pvc-1")
+}
+
+func TestArchiveVolumeTwice(t *testing.T) {
+	cs, _, dir := newFakeControllerServer(t)
+	defer os.RemoveAll(dir)
+
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		}},
+		Parameters: map[string]string{paramServer: "10.0.0.1", paramShare: "/export", paramReclaim: reclaimArchive},
+	}
+
+	// Test that a volume of the same name is archived next to the first one
+	workDir := filepath.Join(dir, "pvc-1")
+	for i, archiveName := range []string{archivedPrefix + "pvc-1", archivedPrefix + "pvc-1-1"} {
+		resp, err := cs.CreateVolume(context.Background(), req)
+		assert.NoError(t, err)
+		marker := filepath.Join(workDir, "pvc-1", "data")
+		assert.NoError(t, ioutil.WriteFile(marker, []byte{byte(i)}, 0644))
+		_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetId()})
+		assert.NoError(t, err)
+		data, err := ioutil.ReadFile(filepath.Join(workDir, archiveName, "data"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{byte(i)}, data)
+	}
+}
@@ -17,8 +17,11 @@ limitations under the License.
 package nfs
 
 import (
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
 
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
@@ -26,9 +29,22 @@ import (
 type driver struct {
 	csiDriver *csicommon.CSIDriver
 	endpoint  string
+	// workingMountDir holds the temporary mounts of the controller
+	workingMountDir string
+	// stateDir holds the records of the targets staged volumes are
+	// published at
+	stateDir string
+	// credentialsDir holds the Kerberos credentials of node mounts
+	credentialsDir string
+	// healthCheckInterval is how often NFS mounts are probed, 0 disables
+	// the health monitor
+	healthCheckInterval time.Duration
 
 	ids *csicommon.DefaultIdentityServer
 	ns  *nodeServer
+	cs  *controllerServer
+
+	prober *mountProber
 
 	cap   []*csi.VolumeCapability_AccessMode
 	cscap []*csi.ControllerServiceCapability
@@ -42,21 +58,23 @@ var (
 	version = "0.2.0"
 )
 
-func NewDriver(nodeID, endpoint string) *driver {
+func NewDriver(nodeID, endpoint, workingMountDir, stateDir, credentialsDir string, healthCheckInterval time.Duration) *driver {
 	glog.Infof("Driver: %v version: %v", driverName, version)
 
 	d := &driver{}
 
 	d.endpoint = endpoint
+	d.workingMountDir = workingMountDir
+	d.stateDir = stateDir
+	d.credentialsDir = credentialsDir
+	d.healthCheckInterval = healthCheckInterval
 
 	csiDriver := csicommon.NewCSIDriver(driverName, version, nodeID)
 	csiDriver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER})
-	// NFS plugin does not support ControllerServiceCapability now.
-	// If support is added, it should set to appropriate
-	// ControllerServiceCapability RPC types.
-	csiDriver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_UNKNOWN})
+	csiDriver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
 
 	d.csiDriver = csiDriver
+	d.prober = newMountProber(probeTimeout)
 
 	return d
 }
@@ -64,15 +82,39 @@ func NewDriver(nodeID, endpoint string) *driver {
 func NewNodeServer(d *driver) *nodeServer {
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d.csiDriver),
+		mounter:           mount.New(""),
+		probe:             d.prober.probe,
+		lazyUnmount:       d.prober.detach,
+		dial:              dialServer,
+		credentials:       newKerberosCredentials(d.credentialsDir),
+		publishes:         newPublishRecord(d.stateDir),
+	}
+}
+
+func NewControllerServer(d *driver) *controllerServer {
+	return &controllerServer{
+		DefaultControllerServer: csicommon.NewDefaultControllerServer(d.csiDriver),
+		workingMountDir:         d.workingMountDir,
+		mounter:                 mount.New(""),
+		dial:                    dialServer,
+		inflight:                map[string]bool{},
 	}
 }
 
 func (d *driver) Run() {
+	if d.healthCheckInterval > 0 {
+		monitor := &healthMonitor{
+			mounter:  mount.New(""),
+			probe:    d.prober.probe,
+			interval: d.healthCheckInterval,
+		}
+		go monitor.run(make(chan struct{}))
+	}
+
 	s := csicommon.NewNonBlockingGRPCServer()
 	s.Start(d.endpoint,
 		csicommon.NewDefaultIdentityServer(d.csiDriver),
-		// NFS plugin has not implemented ControllerServer.
-		nil,
+		NewControllerServer(d),
 		NewNodeServer(d))
 	s.Wait()
 }
@@ -0,0 +1,166 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	// probeTimeout bounds how long a mount is probed before it is
+	// considered stale. A hard mounted share of a dead server never answers.
+	probeTimeout = 10 * time.Second
+)
+
+var errProbeTimeout = errors.New("nfs: mount did not respond in time")
+
+// mountProber probes mounts with a bounded timeout. A probe of an
+// unresponsive mount blocks in the kernel, so at most one probe per path is
+// in flight and later probes of the path wait for the same result. Detaching
+// the mount drops its probe, which may never return, so that a mount at the
+// same path is probed afresh.
+type mountProber struct {
+	timeout time.Duration
+	statfs  func(path string) error
+	unmount func(path string) error
+
+	mu       sync.Mutex
+	inflight map[string]*probeResult
+}
+
+type probeResult struct {
+	done chan struct{}
+	err  error
+}
+
+func newMountProber(timeout time.Duration) *mountProber {
+	return &mountProber{
+		timeout:  timeout,
+		statfs:   statfs,
+		unmount:  lazyUnmount,
+		inflight: map[string]*probeResult{},
+	}
+}
+
+// probe returns the error of statfs on path, or errProbeTimeout if it does
+// not return in time.
+func (p *mountProber) probe(path string) error {
+	p.mu.Lock()
+	result, ok := p.inflight[path]
+	if !ok {
+		result = &probeResult{done: make(chan struct{})}
+		p.inflight[path] = result
+		go func() {
+			result.err = p.statfs(path)
+			p.mu.Lock()
+			if p.inflight[path] == result {
+				delete(p.inflight, path)
+			}
+			p.mu.Unlock()
+			close(result.done)
+		}()
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-result.done:
+		return result.err
+	case <-time.After(p.timeout):
+		return errProbeTimeout
+	}
+}
+
+// detach lazily unmounts the mount at path and drops its in-flight probe.
+func (p *mountProber) detach(path string) error {
+	if err := p.unmount(path); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	delete(p.inflight, path)
+	p.mu.Unlock()
+	return nil
+}
+
+func statfs(path string) error {
+	var st syscall.Statfs_t
+	return syscall.Statfs(path, &st)
+}
+
+// isStale reports whether a probe error means that the mount is stale.
+func isStale(err error) bool {
+	return err == errProbeTimeout || err == syscall.ESTALE
+}
+
+// lazyUnmount detaches a stale mount, it is cleaned up once it is not busy
+// anymore.
+func lazyUnmount(path string) error {
+	return syscall.Unmount(path, syscall.MNT_DETACH)
+}
+
+// healthMonitor periodically probes the NFS mounts of the node and logs the
+// stale ones. Stale mounts are remounted by NodePublishVolume retries.
+type healthMonitor struct {
+	mounter  mount.Interface
+	probe    func(path string) error
+	interval time.Duration
+}
+
+func (m *healthMonitor) run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.check()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// check probes every NFS mount and returns the stale ones.
+func (m *healthMonitor) check() []string {
+	mps, err := m.mounter.List()
+	if err != nil {
+		glog.Errorf("nfs: failed to list mounts: %v", err)
+		return nil
+	}
+	var stale []string
+	total := 0
+	for _, mp := range mps {
+		if mp.Type != "nfs" && mp.Type != "nfs4" {
+			continue
+		}
+		total++
+		if err := m.probe(mp.Path); err != nil {
+			if isStale(err) {
+				glog.Warningf("nfs: mount of %s at %s is stale: %v", mp.Device, mp.Path, err)
+				stale = append(stale, mp.Path)
+			} else {
+				glog.Errorf("nfs: failed to probe mount of %s at %s: %v", mp.Device, mp.Path, err)
+			}
+		}
+	}
+	glog.V(4).Infof("nfs: %d of %d NFS mounts are stale", len(stale), total)
+	return stale
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func TestProbeTimeout(t *testing.T) {
+	block := make(chan struct{})
+	calls := 0
+	p := newMountProber(10 * time.Millisecond)
+	p.statfs = func(path string) error {
+		calls++
+		<-block
+		return nil
+	}
+
+	// Test that a hanging mount times out and is probed only once
+	assert.Equal(t, errProbeTimeout, p.probe("/mnt"))
+	assert.Equal(t, errProbeTimeout, p.probe("/mnt"))
+	assert.True(t, isStale(errProbeTimeout))
+	close(block)
+	assert.NoError(t, p.probe("/mnt"))
+	assert.Equal(t, 1, calls)
+
+	p.statfs = func(path string) error { return syscall.ESTALE }
+	assert.True(t, isStale(p.probe("/other")))
+	assert.False(t, isStale(syscall.ENOENT))
+	assert.False(t, isStale(nil))
+}
+
+func TestProbeAfterDetach(t *testing.T) {
+	// The first probe hangs, the second returns at once
+	hang := make(chan struct{})
+	defer close(hang)
+	ready := make(chan struct{})
+	close(ready)
+	waits := make(chan chan struct{}, 2)
+	waits <- hang
+	waits <- ready
+	p := newMountProber(10 * time.Millisecond)
+	p.statfs = func(path string) error {
+		<-<-waits
+		return nil
+	}
+	var detached []string
+	p.unmount = func(path string) error {
+		detached = append(detached, path)
+		return nil
+	}
+
+	assert.Equal(t, errProbeTimeout, p.probe("/mnt"))
+
+	// Test that a mount at the same path is not reported stale by the probe
+	// of the detached mount
+	assert.NoError(t, p.detach("/mnt"))
+	assert.Equal(t, []string{"/mnt"}, detached)
+	assert.NoError(t, p.probe("/mnt"))
+}
+
+func TestHealthMonitorCheck(t *testing.T) {
+	mounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{
+		{Device: "server:/a", Path: "/mnt/a", Type: "nfs"},
+		{Device: "server:/b", Path: "/mnt/b", Type: "nfs4"},
+		{Device: "/dev/sda1", Path: "/mnt/c", Type: "ext4"},
+	}}
+	var probed []string
+	m := &healthMonitor{
+		mounter: mounter,
+		probe: func(path string) error {
+			probed = append(probed, path)
+			if path == "/mnt/b" {
+				return errProbeTimeout
+			}
+			return nil
+		},
+	}
+
+	assert.Equal(t, []string{"/mnt/b"}, m.check())
+	assert.Equal(t, []string{"/mnt/a", "/mnt/b"}, probed)
+}
+
+func TestPublishStaleTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs-node")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	targetPath := filepath.Join(dir, "target")
+	assert.NoError(t, os.MkdirAll(targetPath, 0750))
+	mounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{
+		{Device: "10.0.0.1:/export", Path: targetPath, Type: "nfs"},
+	}}
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock", dir, filepath.Join(dir, "state"), filepath.Join(dir, "krb5"), 0))
+	ns.mounter = mounter
+	stale := map[string]bool{targetPath: true}
+	ns.probe = func(path string) error {
+		if stale[path] {
+			return syscall.ESTALE
+		}
+		return nil
+	}
+	var detached []string
+	ns.lazyUnmount = func(path string) error {
+		detached = append(detached, path)
+		delete(stale, path)
+		return mounter.Unmount(path)
+	}
+
+	// Test that a stale target is detached and mounted again
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:   "vol",
+		TargetPath: targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeAttributes: map[string]string{"server": "10.0.0.1", "share": "/export"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{targetPath}, detached)
+	assert.Equal(t, 1, len(mounter.MountPoints))
+	assert.Equal(t, targetPath, mounter.MountPoints[0].Path)
+}
+
+func TestUnstageStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs-node")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	stagingPath := filepath.Join(dir, "staging")
+	assert.NoError(t, os.MkdirAll(stagingPath, 0750))
+	mounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{
+		{Device: "10.0.0.1:/export", Path: stagingPath, Type: "nfs"},
+	}}
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock", dir, filepath.Join(dir, "state"), filepath.Join(dir, "krb5"), 0))
+	ns.mounter = mounter
+	ns.probe = func(path string) error {
+		if len(mounter.MountPoints) != 0 {
+			return syscall.ESTALE
+		}
+		return syscall.ENOENT
+	}
+	var detached []string
+	ns.lazyUnmount = func(path string) error {
+		detached = append(detached, path)
+		return mounter.Unmount(path)
+	}
+
+	// Test that a stale staging mount is detached instead of failing unstage
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{stagingPath}, detached)
+	assert.Zero(t, len(mounter.MountPoints))
+}
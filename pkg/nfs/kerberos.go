@@ -0,0 +1,247 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Node stage and publish secrets of Kerberos secured mounts
+const (
+	// secretPrincipal is the principal to obtain a ticket for
+	secretPrincipal = "principal"
+	// secretKeytab is the content of a keytab holding the key of the
+	// principal. Without it the keytab of the node is used.
+	secretKeytab = "keytab"
+
+	keytabFile    = "keytab"
+	principalFile = "principal"
+	// ccachePrefix starts the names of root's credential caches, rpc.gssd
+	// looks up the caches of a user by this prefix and the file owner
+	ccachePrefix = "krb5cc_0_"
+)
+
+// kerberosCredentials materialises the Kerberos secrets of a mount into a
+// directory of its own under dir, readable by root only. The directory holds
+// the keytab, if any, and the principal. The credential cache obtained with
+// them is stored in dir itself, which rpc.gssd must use as its credential
+// cache directory to find it. rpc.gssd picks any valid cache of root for any
+// mount, so all the mounts of a node must use the same principal.
+type kerberosCredentials struct {
+	dir string
+	// kinit obtains a ticket for principal from keytab and stores it in
+	// ccache. An empty keytab selects the default keytab.
+	kinit func(keytab, principal, ccache string) error
+
+	// mu serializes setup so that two mounts cannot store different
+	// principals
+	mu sync.Mutex
+}
+
+func newKerberosCredentials(dir string) *kerberosCredentials {
+	return &kerberosCredentials{dir: dir, kinit: kinit}
+}
+
+// credentialDir returns the directory of the credentials of the mount at
+// mountPath.
+func (k *kerberosCredentials) credentialDir(mountPath string) string {
+	sum := sha256.Sum256([]byte(mountPath))
+	return filepath.Join(k.dir, hex.EncodeToString(sum[:16]))
+}
+
+// ccache returns the credential cache of the mount at mountPath.
+func (k *kerberosCredentials) ccache(mountPath string) string {
+	return filepath.Join(k.dir, ccachePrefix+filepath.Base(k.credentialDir(mountPath)))
+}
+
+// setup materialises the credentials in secrets for the mount at mountPath,
+// which is mounted with options. It does nothing if secrets hold no
+// Kerberos credentials. It returns gRPC errors.
+func (k *kerberosCredentials) setup(mountPath string, secrets map[string]string, options []string) error {
+	principal, keytab := secrets[secretPrincipal], secrets[secretKeytab]
+	if principal == "" && keytab == "" {
+		return nil
+	}
+	if principal == "" {
+		return status.Errorf(codes.InvalidArgument, "secret %q is required with secret %q", secretPrincipal, secretKeytab)
+	}
+	if !isKerberos(options) {
+		return status.Error(codes.InvalidArgument, "Kerberos credentials require mount option sec=krb5, sec=krb5i or sec=krb5p")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	dir := k.credentialDir(mountPath)
+	active, err := k.activePrincipals(dir)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	for _, other := range active {
+		if other != principal {
+			return status.Errorf(codes.FailedPrecondition, "Kerberos principal %s of another mount is in use on the node, rpc.gssd cannot keep it apart from %s", other, principal)
+		}
+	}
+
+	if err := os.MkdirAll(k.dir, 0700); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if keytab != "" {
+		if err := writePrivateFile(filepath.Join(dir, keytabFile), []byte(keytab)); err != nil {
+			k.cleanup(mountPath)
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := writePrivateFile(filepath.Join(dir, principalFile), []byte(principal)); err != nil {
+		k.cleanup(mountPath)
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := k.renew(mountPath); err != nil {
+		k.cleanup(mountPath)
+		return err
+	}
+	return nil
+}
+
+// renew obtains a ticket again with the credentials stored by setup for the
+// mount at mountPath, e.g. to mount it again after it went stale. It does
+// nothing if no credentials are stored. It returns gRPC errors.
+func (k *kerberosCredentials) renew(mountPath string) error {
+	dir := k.credentialDir(mountPath)
+	principal, err := ioutil.ReadFile(filepath.Join(dir, principalFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	keytabPath := filepath.Join(dir, keytabFile)
+	if _, err := os.Stat(keytabPath); os.IsNotExist(err) {
+		keytabPath = ""
+	}
+
+	ccache := k.ccache(mountPath)
+	if err := k.kinit(keytabPath, string(principal), ccache); err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err := os.Chmod(ccache, 0600); err != nil && !os.IsNotExist(err) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	glog.V(4).Infof("nfs: obtained Kerberos credentials of %s for %s", string(principal), mountPath)
+	return nil
+}
+
+// activePrincipals returns the principals stored for the mounts of the node
+// other than the one whose credential directory is skip.
+func (k *kerberosCredentials) activePrincipals(skip string) ([]string, error) {
+	files, err := ioutil.ReadDir(k.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var principals []string
+	for _, fi := range files {
+		dir := filepath.Join(k.dir, fi.Name())
+		if !fi.IsDir() || dir == skip {
+			continue
+		}
+		principal, err := ioutil.ReadFile(filepath.Join(dir, principalFile))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		principals = append(principals, string(principal))
+	}
+	return principals, nil
+}
+
+// cleanup removes the credentials of the mount at mountPath, removing missing
+// credentials is not an error.
+func (k *kerberosCredentials) cleanup(mountPath string) error {
+	if err := os.Remove(k.ccache(mountPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(k.credentialDir(mountPath))
+}
+
+// isKerberos reports whether options select Kerberos security flavours only.
+func isKerberos(options []string) bool {
+	for _, opt := range options {
+		key, value := splitOption(opt)
+		if key != "sec" {
+			continue
+		}
+		for _, flavor := range strings.Split(value, ":") {
+			if !strings.HasPrefix(flavor, "krb5") {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// writePrivateFile writes data to a file only root can read.
+func writePrivateFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func kinit(keytab, principal, ccache string) error {
+	args := []string{"-k", "-c", "FILE:" + ccache}
+	if keytab != "" {
+		args = append(args, "-t", keytab)
+	}
+	args = append(args, principal)
+	if out, err := exec.Command("kinit", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("nfs: failed to obtain Kerberos credentials of %s: %v: %s", principal, err, string(out))
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+// fakeKinit writes the principal into the credential cache
+func fakeKinit(keytab, principal, ccache string) error {
+	if principal == "bad@EXAMPLE.COM" {
+		return errors.New("nfs: failed to obtain Kerberos credentials")
+	}
+	return ioutil.WriteFile(ccache, []byte(principal), 0644)
+}
+
+func TestKerberosCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs-krb5")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	k := newKerberosCredentials(filepath.Join(dir, "krb5"))
+	k.kinit = fakeKinit
+	krb5p := []string{"vers=4.1", "sec=krb5p"}
+	secrets := map[string]string{secretPrincipal: "nfs@EXAMPLE.COM", secretKeytab: "keys"}
+
+	// Test that no secrets need no Kerberos
+	assert.NoError(t, k.setup("/mnt/a", nil, []string{"sec=sys"}))
+	_, err = os.Stat(k.credentialDir("/mnt/a"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Test invalid secrets and mount options
+	err = k.setup("/mnt/a", map[string]string{secretKeytab: "keys"}, krb5p)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	err = k.setup("/mnt/a", secrets, []string{"sec=sys"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	err = k.setup("/mnt/a", secrets, []string{"sec=krb5p:sys"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	err = k.setup("/mnt/a", map[string]string{secretPrincipal: "bad@EXAMPLE.COM"}, krb5p)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = os.Stat(k.credentialDir("/mnt/a"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, k.setup("/mnt/a", secrets, krb5p))
+	credDir := k.credentialDir("/mnt/a")
+	assert.NotEqual(t, credDir, k.credentialDir("/mnt/b"))
+	for path, mode := range map[string]os.FileMode{
+		credDir:                               os.ModeDir | 0700,
+		filepath.Join(credDir, keytabFile):    0600,
+		filepath.Join(credDir, principalFile): 0600,
+		k.ccache("/mnt/a"):                    0600,
+	} {
+		fi, err := os.Stat(path)
+		assert.NoError(t, err, path)
+		assert.Equal(t, mode, fi.Mode(), path)
+	}
+	keytab, err := ioutil.ReadFile(filepath.Join(credDir, keytabFile))
+	assert.NoError(t, err)
+	assert.Equal(t, "keys", string(keytab))
+
+	// Test that renewing uses the stored credentials
+	var renewed []string
+	k.kinit = func(keytab, principal, ccache string) error {
+		renewed = append(renewed, keytab, principal, ccache)
+		return nil
+	}
+	assert.NoError(t, k.renew("/mnt/a"))
+	assert.Equal(t, []string{filepath.Join(credDir, keytabFile), "nfs@EXAMPLE.COM", k.ccache("/mnt/a")}, renewed)
+	assert.NoError(t, k.renew("/mnt/b"))
+	assert.Equal(t, 3, len(renewed))
+
+	// Test that a second mount cannot use another principal
+	assert.NoError(t, k.setup("/mnt/b", secrets, krb5p))
+	err = k.setup("/mnt/c", map[string]string{secretPrincipal: "other@EXAMPLE.COM"}, krb5p)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = os.Stat(k.credentialDir("/mnt/c"))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, k.cleanup("/mnt/b"))
+
+	// Test that cleanup is idempotent
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, k.cleanup("/mnt/a"))
+		for _, path := range []string{credDir, k.ccache("/mnt/a")} {
+			_, err = os.Stat(path)
+			assert.True(t, os.IsNotExist(err), path)
+		}
+	}
+
+	// Test that another principal can be used once the mounts are gone
+	assert.NoError(t, k.setup("/mnt/c", map[string]string{secretPrincipal: "other@EXAMPLE.COM"}, krb5p))
+}
+
+// gssdMounter looks up root's credential caches in dir like rpc.gssd at mount
+// time and records their content
+type gssdMounter struct {
+	*csicommon.RecordingMounter
+	dir     string
+	ccaches []string
+}
+
+func (m *gssdMounter) Mount(source, target, fstype string, options []string) error {
+	m.ccaches = nil
+	files, err := ioutil.ReadDir(m.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && strings.HasPrefix(fi.Name(), "krb5cc_0") {
+			content, err := ioutil.ReadFile(filepath.Join(m.dir, fi.Name()))
+			if err != nil {
+				return err
+			}
+			m.ccaches = append(m.ccaches, string(content))
+		}
+	}
+	return m.RecordingMounter.Mount(source, target, fstype, options)
+}
+
+func TestPublishKerberos(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs-node")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock", dir, filepath.Join(dir, "state"), filepath.Join(dir, "krb5"), 0))
+	mounter := &gssdMounter{RecordingMounter: csicommon.NewRecordingMounter(), dir: filepath.Join(dir, "krb5")}
+	ns.mounter = mounter
+	ns.credentials.kinit = fakeKinit
+
+	targetPath := filepath.Join(dir, "target")
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:   "vol",
+		TargetPath: targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeAttributes:   map[string]string{"server": "10.0.0.1", "share": "/export", attrNFSVersion: "4.1", attrSec: "krb5p"},
+		NodePublishSecrets: map[string]string{secretPrincipal: "nfs@EXAMPLE.COM"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(mounter.MountPoints))
+	assert.Contains(t, mounter.Opts[targetPath], "sec=krb5p")
+	assert.Equal(t, []string{"nfs@EXAMPLE.COM"}, mounter.ccaches)
+
+	// Test that unpublish removes the credentials
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: targetPath})
+	assert.NoError(t, err)
+	for _, path := range []string{ns.credentials.credentialDir(targetPath), ns.credentials.ccache(targetPath)} {
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+}
+
+func TestRemountStaleKerberos(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs-node")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock", dir, filepath.Join(dir, "state"), filepath.Join(dir, "krb5"), 0))
+	mounter := &gssdMounter{RecordingMounter: csicommon.NewRecordingMounter(), dir: filepath.Join(dir, "krb5")}
+	ns.mounter = mounter
+	ns.credentials.kinit = fakeKinit
+	stale := map[string]bool{}
+	ns.probe = func(path string) error {
+		if stale[path] {
+			return syscall.ESTALE
+		}
+		return nil
+	}
+	ns.lazyUnmount = func(path string) error {
+		delete(stale, path)
+		return mounter.Unmount(path)
+	}
+
+	stagingPath := filepath.Join(dir, "staging")
+	attributes := map[string]string{"server": "10.0.0.1", "share": "/export", attrNFSVersion: "4.1", attrSec: "krb5p"}
+	cap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}
+	_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  cap,
+		VolumeAttributes:  attributes,
+		NodeStageSecrets:  map[string]string{secretPrincipal: "stage@EXAMPLE.COM"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"stage@EXAMPLE.COM"}, mounter.ccaches)
+
+	// Test that a stale staging mount is mounted again with the stage
+	// credentials rather than the publish secrets
+	stale[stagingPath] = true
+	assert.NoError(t, os.Remove(ns.credentials.ccache(stagingPath)))
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:           "vol",
+		StagingTargetPath:  stagingPath,
+		TargetPath:         filepath.Join(dir, "target"),
+		VolumeCapability:   cap,
+		VolumeAttributes:   attributes,
+		NodePublishSecrets: map[string]string{secretPrincipal: "publish@EXAMPLE.COM"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(mounter.MountPoints))
+	ccache, err := ioutil.ReadFile(ns.credentials.ccache(stagingPath))
+	assert.NoError(t, err)
+	assert.Equal(t, "stage@EXAMPLE.COM", string(ccache))
+}
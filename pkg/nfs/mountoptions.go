@@ -0,0 +1,211 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Volume attributes, and StorageClass parameters, which select mount options
+const (
+	attrNFSVersion = "nfsVersion"
+	attrProto      = "proto"
+	attrTimeo      = "timeo"
+	attrHard       = "hard"
+	attrSec        = "sec"
+)
+
+// mountAttributes lists the attributes handled by buildMountOptions
+var mountAttributes = []string{attrNFSVersion, attrProto, attrTimeo, attrHard, attrSec}
+
+var (
+	nfsVersions  = []string{"3", "4", "4.0", "4.1", "4.2"}
+	nfsProtos    = []string{"tcp", "udp", "rdma"}
+	nfsSecFlavor = []string{"sys", "krb5", "krb5i", "krb5p", "none"}
+)
+
+// buildMountOptions combines the mount flags of a volume capability with the
+// options selected by volume attributes, validates the result and returns the
+// filesystem type to mount with. Errors name the offending option.
+func buildMountOptions(attributes map[string]string, flags []string, readOnly bool) (string, []string, error) {
+	opts := map[string]string{}
+	var options []string
+	add := func(opt string) error {
+		key, value := splitOption(opt)
+		if prev, ok := opts[key]; ok && prev != value {
+			return fmt.Errorf("conflicting mount options %q and %q", key+joinValue(prev), opt)
+		}
+		if _, ok := opts[key]; !ok {
+			opts[key] = value
+			options = append(options, opt)
+		}
+		return nil
+	}
+
+	for _, flag := range flags {
+		flag = strings.TrimSpace(flag)
+		if flag == "" {
+			continue
+		}
+		if err := validateOption(flag); err != nil {
+			return "", nil, err
+		}
+		// Normalize the option aliases so that conflicts are detected
+		key, value := splitOption(flag)
+		switch key {
+		case "nfsvers":
+			flag = "vers=" + value
+		case "tcp", "udp", "rdma":
+			flag = "proto=" + key
+		}
+		if err := add(flag); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if v, ok := attributes[attrNFSVersion]; ok {
+		if !contains(nfsVersions, v) {
+			return "", nil, fmt.Errorf("invalid %s %q, expected one of %v", attrNFSVersion, v, nfsVersions)
+		}
+		if err := add("vers=" + v); err != nil {
+			return "", nil, err
+		}
+	}
+	if v, ok := attributes[attrProto]; ok {
+		if !contains(nfsProtos, v) {
+			return "", nil, fmt.Errorf("invalid %s %q, expected one of %v", attrProto, v, nfsProtos)
+		}
+		if err := add("proto=" + v); err != nil {
+			return "", nil, err
+		}
+	}
+	if v, ok := attributes[attrTimeo]; ok {
+		if n, err := strconv.Atoi(v); err != nil || n <= 0 {
+			return "", nil, fmt.Errorf("invalid %s %q, expected a positive number of deciseconds", attrTimeo, v)
+		}
+		if err := add("timeo=" + v); err != nil {
+			return "", nil, err
+		}
+	}
+	if v, ok := attributes[attrHard]; ok {
+		hard, err := strconv.ParseBool(v)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid %s %q, expected true or false", attrHard, v)
+		}
+		opt := "soft"
+		if hard {
+			opt = "hard"
+		}
+		if err := add(opt); err != nil {
+			return "", nil, err
+		}
+	}
+	if v, ok := attributes[attrSec]; ok {
+		if !contains(nfsSecFlavor, v) {
+			return "", nil, fmt.Errorf("invalid %s %q, expected one of %v", attrSec, v, nfsSecFlavor)
+		}
+		if err := add("sec=" + v); err != nil {
+			return "", nil, err
+		}
+	}
+	if readOnly {
+		if _, ok := opts["rw"]; ok {
+			return "", nil, fmt.Errorf("mount option \"rw\" conflicts with a read only volume")
+		}
+		if err := add("ro"); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// Check the combination of the options
+	if _, hard := opts["hard"]; hard {
+		if _, soft := opts["soft"]; soft {
+			return "", nil, fmt.Errorf("conflicting mount options \"hard\" and \"soft\"")
+		}
+	}
+	if _, ro := opts["ro"]; ro {
+		if _, rw := opts["rw"]; rw {
+			return "", nil, fmt.Errorf("conflicting mount options \"ro\" and \"rw\"")
+		}
+	}
+	fsType := "nfs"
+	if strings.HasPrefix(opts["vers"], "4") {
+		fsType = "nfs4"
+		if opts["proto"] == "udp" {
+			return "", nil, fmt.Errorf("mount option \"proto=udp\" is not supported by NFS version %s", opts["vers"])
+		}
+	}
+	return fsType, options, nil
+}
+
+// validateOption checks the value of the mount options buildMountOptions
+// interprets. Other options are passed on to mount as they are, mount
+// reports the ones it does not know.
+func validateOption(opt string) error {
+	key, value := splitOption(opt)
+	switch key {
+	case "vers", "nfsvers":
+		if !contains(nfsVersions, value) {
+			return fmt.Errorf("invalid mount option %q, expected %s= one of %v", opt, key, nfsVersions)
+		}
+	case "proto":
+		if !contains(nfsProtos, value) {
+			return fmt.Errorf("invalid mount option %q, expected %s= one of %v", opt, key, nfsProtos)
+		}
+	case "sec":
+		for _, flavor := range strings.Split(value, ":") {
+			if !contains(nfsSecFlavor, flavor) {
+				return fmt.Errorf("invalid mount option %q, expected %s= one of %v", opt, key, nfsSecFlavor)
+			}
+		}
+	case "timeo":
+		if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+			return fmt.Errorf("invalid mount option %q, expected a positive number of deciseconds", opt)
+		}
+	case "hard", "soft", "ro", "rw", "tcp", "udp", "rdma":
+		if strings.Contains(opt, "=") {
+			return fmt.Errorf("mount option %q does not take a value", key)
+		}
+	}
+	return nil
+}
+
+func splitOption(opt string) (string, string) {
+	kv := strings.SplitN(opt, "=", 2)
+	if len(kv) == 1 {
+		return kv[0], ""
+	}
+	return kv[0], kv[1]
+}
+
+func joinValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "=" + value
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
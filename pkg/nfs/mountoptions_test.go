@@ -0,0 +1,84 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildMountOptions(t *testing.T) {
+	// Test plain mount flags
+	fsType, options, err := buildMountOptions(nil, []string{"nfsvers=3", "noac"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "nfs", fsType)
+	assert.Equal(t, []string{"vers=3", "noac"}, options)
+
+	// Test attributes
+	fsType, options, err = buildMountOptions(map[string]string{
+		attrNFSVersion: "4.1",
+		attrProto:      "tcp",
+		attrTimeo:      "600",
+		attrHard:       "true",
+		attrSec:        "krb5p",
+	}, nil, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "nfs4", fsType)
+	assert.Equal(t, []string{"vers=4.1", "proto=tcp", "timeo=600", "hard", "sec=krb5p", "ro"}, options)
+
+	// Test that options the driver does not interpret are passed on
+	_, options, err = buildMountOptions(nil, []string{"nconnect=4", "addr=10.0.0.1", "context=system_u:object_r:nfs_t:s0", "nofail", "defaults"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nconnect=4", "addr=10.0.0.1", "context=system_u:object_r:nfs_t:s0", "nofail", "defaults"}, options)
+
+	// Test that an attribute may repeat a mount flag
+	_, options, err = buildMountOptions(map[string]string{attrProto: "tcp"}, []string{"tcp"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"proto=tcp"}, options)
+}
+
+func TestBuildMountOptionsInvalid(t *testing.T) {
+	tests := []struct {
+		attributes map[string]string
+		flags      []string
+		readOnly   bool
+		errorPart  string
+	}{
+		{flags: []string{"timeo"}, errorPart: "timeo"},
+		{flags: []string{"nfsvers=5"}, errorPart: "nfsvers=5"},
+		{flags: []string{"vers=4.3"}, errorPart: "vers=4.3"},
+		{flags: []string{"proto=sctp"}, errorPart: "proto=sctp"},
+		{flags: []string{"sec=krb5:dh"}, errorPart: "sec=krb5:dh"},
+		{flags: []string{"hard=1"}, errorPart: "hard"},
+		{flags: []string{"hard", "soft"}, errorPart: "soft"},
+		{flags: []string{"vers=3"}, attributes: map[string]string{attrNFSVersion: "4"}, errorPart: "vers=3"},
+		{attributes: map[string]string{attrNFSVersion: "5"}, errorPart: attrNFSVersion},
+		{attributes: map[string]string{attrProto: "sctp"}, errorPart: attrProto},
+		{attributes: map[string]string{attrTimeo: "-1"}, errorPart: attrTimeo},
+		{attributes: map[string]string{attrHard: "maybe"}, errorPart: attrHard},
+		{attributes: map[string]string{attrSec: "krb6"}, errorPart: attrSec},
+		{attributes: map[string]string{attrNFSVersion: "4", attrProto: "udp"}, errorPart: "proto=udp"},
+		{flags: []string{"rw"}, readOnly: true, errorPart: "rw"},
+	}
+	for _, test := range tests {
+		_, _, err := buildMountOptions(test.attributes, test.flags, test.readOnly)
+		if assert.Error(t, err, "%v %v", test.attributes, test.flags) {
+			assert.Contains(t, err.Error(), test.errorPart)
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -31,13 +32,33 @@ import (
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
+// nodeServer mounts an NFS share once per node at the staging path in
+// NodeStageVolume, NodePublishVolume bind mounts it from there on each target
+// path. The targets are recorded per staging path, which tells
+// NodeUnstageVolume whether publishes remain.
+//
+// Mounts of a failed server go stale. NodePublishVolume detaches stale
+// staging and target mounts and mounts them again, see health.go.
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	mounter     mount.Interface
+	probe       func(path string) error
+	lazyUnmount func(path string) error
+	// dial checks that a server is reachable
+	dial func(server string) error
+	// credentials holds the Kerberos credentials of staged and published
+	// mounts
+	credentials *kerberosCredentials
+	// publishes records the targets of each staging path
+	publishes *publishRecord
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	targetPath := req.GetTargetPath()
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	if _, err := ns.detachIfStale(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if err := os.MkdirAll(targetPath, 0750); err != nil {
@@ -53,57 +74,264 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
-	mo := req.GetVolumeCapability().GetMount().GetMountFlags()
-	if req.GetReadonly() {
-		mo = append(mo, "ro")
+	// Bind mount the share staged by NodeStageVolume
+	if stagingPath := req.GetStagingTargetPath(); len(stagingPath) != 0 {
+		stale, err := ns.detachIfStale(stagingPath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if stale {
+			// Mount the share again the way NodeStageVolume did, with the
+			// credentials stored from the node stage secrets
+			fsType, mo, err := buildMountOptions(req.GetVolumeAttributes(), req.GetVolumeCapability().GetMount().GetMountFlags(), false)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			if err := ns.credentials.renew(stagingPath); err != nil {
+				return nil, err
+			}
+			if err := ns.mountShare(req.GetVolumeAttributes(), stagingPath, fsType, mo); err != nil {
+				return nil, err
+			}
+		}
+		notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err != nil || notMnt {
+			return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is not staged at %s", req.GetVolumeId(), stagingPath)
+		}
+		options := []string{"bind"}
+		if req.GetReadonly() {
+			options = append(options, "ro")
+		}
+		if err := ns.mounter.Mount(stagingPath, targetPath, "", options); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := ns.publishes.add(stagingPath, targetPath); err != nil {
+			ns.mounter.Unmount(targetPath)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
-	s := req.GetVolumeAttributes()["server"]
-	ep := req.GetVolumeAttributes()["share"]
-	source := fmt.Sprintf("%s:%s", s, ep)
-
-	mounter := mount.New("")
-	err = mounter.Mount(source, targetPath, "nfs", mo)
+	fsType, mo, err := buildMountOptions(req.GetVolumeAttributes(), req.GetVolumeCapability().GetMount().GetMountFlags(), req.GetReadonly())
 	if err != nil {
-		if os.IsPermission(err) {
-			return nil, status.Error(codes.PermissionDenied, err.Error())
-		}
-		if strings.Contains(err.Error(), "invalid argument") {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
-		}
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := ns.credentials.setup(targetPath, req.GetNodePublishSecrets(), mo); err != nil {
+		return nil, err
+	}
+	if err := ns.mountShare(req.GetVolumeAttributes(), targetPath, fsType, mo); err != nil {
+		ns.credentials.cleanup(targetPath)
+		return nil, err
 	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+
+	// A stale target would hang the mount point check below
 	targetPath := req.GetTargetPath()
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	if _, err := ns.detachIfStale(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if source := ns.getMountSource(targetPath); source != "" {
+		glog.V(4).Infof("nfs: unpublishing %s mounted from %s", targetPath, source)
+	}
+
+	// UnmountPath succeeds for missing and already unmounted targets and
+	// removes the leftover directory
+	if err := util.UnmountPath(targetPath, ns.mounter); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.publishes.remove(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.credentials.cleanup(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
 
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	mountPoints, err := ns.mounter.List()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	mounted := map[string]bool{}
+	for _, mp := range mountPoints {
+		mounted[mp.Path] = true
+	}
+	targets, err := ns.publishes.prune(stagingPath, func(target string) bool { return mounted[target] })
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if len(targets) != 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is still published at %v", req.GetVolumeId(), targets)
+	}
+
+	// A stale staging mount fails the mount point check below, once
+	// detached it is unstaged like an unmounted one
+	if _, err := ns.detachIfStale(stagingPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err != nil || notMnt {
+		// Already unstaged
+		if err := ns.credentials.cleanup(stagingPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	if err := util.UnmountPath(stagingPath, ns.mounter); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.credentials.cleanup(stagingPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, status.Error(codes.NotFound, "Targetpath not found")
+			if err := os.MkdirAll(stagingPath, 0750); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
 		} else {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
-	if notMnt {
-		return nil, status.Error(codes.NotFound, "Volume not mounted")
+
+	if !notMnt {
+		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	err = util.UnmountPath(req.GetTargetPath(), mount.New(""))
+	// The share is staged read-write, publishes may still be read only
+	fsType, mo, err := buildMountOptions(req.GetVolumeAttributes(), req.GetVolumeCapability().GetMount().GetMountFlags(), false)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := ns.credentials.setup(stagingPath, req.GetNodeStageSecrets(), mo); err != nil {
+		return nil, err
+	}
+	if err := ns.mountShare(req.GetVolumeAttributes(), stagingPath, fsType, mo); err != nil {
+		ns.credentials.cleanup(stagingPath)
+		return nil, err
 	}
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return &csi.NodeUnstageVolumeResponse{}, nil
+func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+					},
+				},
+			},
+		},
+	}, nil
 }
 
-func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return &csi.NodeStageVolumeResponse{}, nil
+// detachIfStale probes the mount at path and lazily unmounts it if it is
+// stale. It returns whether the mount was stale.
+func (ns *nodeServer) detachIfStale(path string) (bool, error) {
+	err := ns.probe(path)
+	if !isStale(err) {
+		return false, nil
+	}
+	glog.Warningf("nfs: mount at %s is stale (%v), detaching it", path, err)
+	if err := ns.lazyUnmount(path); err != nil {
+		return true, fmt.Errorf("failed to detach stale mount at %s: %v", path, err)
+	}
+	return true, nil
+}
+
+// mountShare mounts the share given by the server and share attributes on
+// targetPath. The server attribute may list several servers exporting the
+// share, the first reachable one is mounted.
+func (ns *nodeServer) mountShare(attributes map[string]string, targetPath, fsType string, options []string) error {
+	servers, err := parseServers(attributes[paramServer])
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	server, err := selectServer(servers, ns.dial)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	source := mountSource(server, attributes[paramShare])
+
+	glog.V(4).Infof("nfs: mounting %s at %s", source, targetPath)
+	err = ns.mounter.Mount(source, targetPath, fsType, options)
+	if err != nil {
+		if os.IsPermission(err) {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+		if strings.Contains(err.Error(), "invalid argument") {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// getMountSource returns the device mounted at path as reported by the mount
+// table, i.e. the server and share it was mounted from, or "" if unknown.
+func (ns *nodeServer) getMountSource(path string) string {
+	mps, err := ns.mounter.List()
+	if err != nil {
+		glog.Warningf("nfs: failed to list mounts: %v", err)
+		return ""
+	}
+	for _, mp := range mps {
+		if mp.Path == path {
+			return mp.Device
+		}
+	}
+	return ""
 }
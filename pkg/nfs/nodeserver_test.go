@@ -0,0 +1,189 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+func TestStagePublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs-node")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock", dir, filepath.Join(dir, "state"), filepath.Join(dir, "krb5"), 0))
+	mounter := csicommon.NewRecordingMounter()
+	ns.mounter = mounter
+
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+	attributes := map[string]string{"server": "10.0.0.1", "share": "/export", attrNFSVersion: "4.1"}
+	cap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}
+
+	// Test publishing a volume which is not staged
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  cap,
+		VolumeAttributes:  attributes,
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.NoError(t, os.Remove(targetPath))
+
+	// Test that the share is mounted once
+	for i := 0; i < 2; i++ {
+		_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol",
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  cap,
+			VolumeAttributes:  attributes,
+		})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, len(mounter.MountPoints))
+	assert.Equal(t, "10.0.0.1:/export", mounter.MountPoints[0].Device)
+	assert.Equal(t, "nfs4", mounter.MountPoints[0].Type)
+
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  cap,
+		VolumeAttributes:  attributes,
+		Readonly:          true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(mounter.MountPoints))
+	assert.Equal(t, []string{"bind", "ro"}, mounter.Opts[targetPath])
+
+	// Test that unstage is refused while the volume is published
+	unstage := &csi.NodeUnstageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath}
+	_, err = ns.NodeUnstageVolume(context.Background(), unstage)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: targetPath})
+	assert.NoError(t, err)
+	_, err = ns.NodeUnstageVolume(context.Background(), unstage)
+	assert.NoError(t, err)
+	assert.Zero(t, len(mounter.MountPoints))
+
+	// Test that unstage is idempotent
+	_, err = ns.NodeUnstageVolume(context.Background(), unstage)
+	assert.NoError(t, err)
+}
+
+func TestUnstageSharedExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs-node")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock", dir, filepath.Join(dir, "state"), filepath.Join(dir, "krb5"), 0))
+	mounter := &mount.FakeMounter{}
+	ns.mounter = mounter
+	attributes := map[string]string{"server": "10.0.0.1", "share": "/export"}
+	cap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}
+
+	// Stage two volumes of the same export and publish the second one
+	for _, vol := range []string{"a", "b"} {
+		_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          vol,
+			StagingTargetPath: filepath.Join(dir, "staging", vol),
+			VolumeCapability:  cap,
+			VolumeAttributes:  attributes,
+		})
+		assert.NoError(t, err)
+	}
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "b",
+		StagingTargetPath: filepath.Join(dir, "staging", "b"),
+		TargetPath:        filepath.Join(dir, "target"),
+		VolumeCapability:  cap,
+		VolumeAttributes:  attributes,
+	})
+	assert.NoError(t, err)
+
+	// Test that the publish of the second volume does not block unstaging
+	// the first one
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "a", StagingTargetPath: filepath.Join(dir, "staging", "a")})
+	assert.NoError(t, err)
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "b", StagingTargetPath: filepath.Join(dir, "staging", "b")})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, 2, len(mounter.MountPoints))
+
+	// Test that a publish which was unmounted outside of the driver, e.g. by
+	// a reboot, does not block unstaging
+	assert.NoError(t, mounter.Unmount(filepath.Join(dir, "target")))
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "b", StagingTargetPath: filepath.Join(dir, "staging", "b")})
+	assert.NoError(t, err)
+	assert.Empty(t, mounter.MountPoints)
+}
+
+func TestUnpublishIdempotent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs-node")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock", dir, filepath.Join(dir, "state"), filepath.Join(dir, "krb5"), 0))
+	mounter := &mount.FakeMounter{}
+	ns.mounter = mounter
+	targetPath := filepath.Join(dir, "target")
+
+	// Test missing arguments
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{TargetPath: targetPath})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req := &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: targetPath}
+
+	// Test a missing target
+	_, err = ns.NodeUnpublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+
+	// Test that a leftover directory of an unmounted target is removed
+	assert.NoError(t, os.MkdirAll(targetPath, 0750))
+	_, err = ns.NodeUnpublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	_, err = os.Stat(targetPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test a mounted target
+	assert.NoError(t, os.MkdirAll(targetPath, 0750))
+	assert.NoError(t, mounter.Mount("10.0.0.1:/export", targetPath, "nfs", nil))
+	_, err = ns.NodeUnpublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Zero(t, len(mounter.MountPoints))
+	_, err = os.Stat(targetPath)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// publishRecord records the target paths each staging path is published at,
+// in a file per staging path under dir. Bind mounts cannot be told apart from
+// other mounts of the same share in the mount table, so NodeUnstageVolume
+// relies on the record to find the remaining publishes.
+type publishRecord struct {
+	dir string
+
+	mu sync.Mutex
+}
+
+// publishState is the content of the file of a staging path.
+type publishState struct {
+	StagingPath string   `json:"stagingPath"`
+	Targets     []string `json:"targets"`
+}
+
+func newPublishRecord(dir string) *publishRecord {
+	return &publishRecord{dir: dir}
+}
+
+// add records that stagingPath is published at targetPath.
+func (r *publishRecord) add(stagingPath, targetPath string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state, err := r.load(r.file(stagingPath))
+	if err != nil {
+		return err
+	}
+	for _, target := range state.Targets {
+		if target == targetPath {
+			return nil
+		}
+	}
+	state.StagingPath = stagingPath
+	state.Targets = append(state.Targets, targetPath)
+	return r.save(r.file(stagingPath), state)
+}
+
+// remove drops targetPath from the record of the staging path it is
+// published from, if any. Unpublish requests carry no staging path, so every
+// file is searched.
+func (r *publishRecord) remove(targetPath string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(r.dir, fi.Name())
+		state, err := r.load(path)
+		if err != nil {
+			return err
+		}
+		targets := state.Targets[:0]
+		for _, target := range state.Targets {
+			if target != targetPath {
+				targets = append(targets, target)
+			}
+		}
+		if len(targets) == len(state.Targets) {
+			continue
+		}
+		state.Targets = targets
+		if err := r.save(path, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prune drops the targets of stagingPath that are no longer mounted, e.g.
+// after a reboot or an unmount outside of the driver, and returns the
+// remaining ones.
+func (r *publishRecord) prune(stagingPath string, mounted func(target string) bool) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path := r.file(stagingPath)
+	state, err := r.load(path)
+	if err != nil {
+		return nil, err
+	}
+	var targets []string
+	for _, target := range state.Targets {
+		if mounted(target) {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) != len(state.Targets) {
+		state.Targets = targets
+		if err := r.save(path, state); err != nil {
+			return nil, err
+		}
+	}
+	return targets, nil
+}
+
+func (r *publishRecord) file(stagingPath string) string {
+	sum := sha256.Sum256([]byte(stagingPath))
+	return filepath.Join(r.dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// load reads the state in path, a missing file is an empty state.
+func (r *publishRecord) load(path string) (*publishState, error) {
+	state := &publishState{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// save writes state to path, or removes path if no targets remain. The file
+// is replaced atomically so that a crash leaves either state.
+func (r *publishRecord) save(path string, state *publishState) error {
+	if len(state.Targets) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs-state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r := newPublishRecord(filepath.Join(dir, "state"))
+	mounted := func(string) bool { return true }
+
+	// Test a missing record
+	targets, err := r.prune("/staging/a", mounted)
+	assert.NoError(t, err)
+	assert.Empty(t, targets)
+	assert.NoError(t, r.remove("/target/1"))
+
+	// Test that adding is idempotent and records are per staging path
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, r.add("/staging/a", "/target/1"))
+	}
+	assert.NoError(t, r.add("/staging/a", "/target/2"))
+	assert.NoError(t, r.add("/staging/b", "/target/3"))
+	targets, err = r.prune("/staging/a", mounted)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/target/1", "/target/2"}, targets)
+
+	// Test that the record survives a restart
+	r = newPublishRecord(filepath.Join(dir, "state"))
+	assert.NoError(t, r.remove("/target/1"))
+	targets, err = r.prune("/staging/a", mounted)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/target/2"}, targets)
+
+	// Test that the file is removed with the last target
+	assert.NoError(t, r.remove("/target/2"))
+	_, err = os.Stat(r.file("/staging/a"))
+	assert.True(t, os.IsNotExist(err))
+	targets, err = r.prune("/staging/b", mounted)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/target/3"}, targets)
+
+	// Test that targets which are no longer mounted are dropped
+	assert.NoError(t, r.add("/staging/b", "/target/4"))
+	targets, err = r.prune("/staging/b", func(target string) bool { return target == "/target/4" })
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/target/4"}, targets)
+	targets, err = r.prune("/staging/b", func(string) bool { return false })
+	assert.NoError(t, err)
+	assert.Empty(t, targets)
+	_, err = os.Stat(r.file("/staging/b"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// nfsPort is probed to find a reachable server
+	nfsPort = "2049"
+	// dialTimeout bounds the reachability probe of a server
+	dialTimeout = 2 * time.Second
+)
+
+// parseServers parses the server attribute, a single server, a comma
+// separated list or a JSON list like the iSCSI portals attribute.
+func parseServers(value string) ([]string, error) {
+	var list []string
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		if err := json.Unmarshal([]byte(value), &list); err != nil {
+			return nil, fmt.Errorf("invalid server list %q: %v", value, err)
+		}
+	} else {
+		list = strings.Split(value, ",")
+	}
+	var servers []string
+	for _, server := range list {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if strings.ContainsAny(server, ":/") && net.ParseIP(server) == nil {
+			return nil, fmt.Errorf("invalid server %q", server)
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no server in %q", value)
+	}
+	return servers, nil
+}
+
+// dialServer checks that server accepts TCP connections on the NFS port.
+func dialServer(server string) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(server, nfsPort), dialTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// selectServer returns the first of servers which dial reaches. A single
+// server is returned without probing, mounting it reports its errors.
+func selectServer(servers []string, dial func(server string) error) (string, error) {
+	if len(servers) == 1 {
+		return servers[0], nil
+	}
+	var errs []string
+	for _, server := range servers {
+		err := dial(server)
+		if err == nil {
+			return server, nil
+		}
+		glog.Warningf("nfs: server %s is not reachable: %v", server, err)
+		errs = append(errs, err.Error())
+	}
+	return "", fmt.Errorf("none of the servers %v is reachable: %s", servers, strings.Join(errs, "; "))
+}
+
+// mountSource returns the NFS source of a server and an export path, IPv6
+// addresses are enclosed in brackets.
+func mountSource(server, share string) string {
+	if ip := net.ParseIP(server); ip != nil && ip.To4() == nil {
+		return fmt.Sprintf("[%s]:%s", server, share)
+	}
+	return fmt.Sprintf("%s:%s", server, share)
+}
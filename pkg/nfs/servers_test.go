@@ -0,0 +1,123 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func TestParseServers(t *testing.T) {
+	tests := []struct {
+		value   string
+		servers []string
+	}{
+		{"10.0.0.1", []string{"10.0.0.1"}},
+		{"10.0.0.1, nfs.example.com,", []string{"10.0.0.1", "nfs.example.com"}},
+		{`["10.0.0.1", "fd00::1"]`, []string{"10.0.0.1", "fd00::1"}},
+		{"fd00::1,fd00::2", []string{"fd00::1", "fd00::2"}},
+	}
+	for _, test := range tests {
+		servers, err := parseServers(test.value)
+		assert.NoError(t, err, test.value)
+		assert.Equal(t, test.servers, servers, test.value)
+	}
+
+	for _, value := range []string{"", " , ", `["10.0.0.1"`, "10.0.0.1:/export"} {
+		_, err := parseServers(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestSelectServer(t *testing.T) {
+	var dialed []string
+	dial := func(server string) error {
+		dialed = append(dialed, server)
+		if server == "10.0.0.1" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	// Test that a single server is not probed
+	server, err := selectServer([]string{"10.0.0.1"}, dial)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", server)
+	assert.Empty(t, dialed)
+
+	server, err = selectServer([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, dial)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", server)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, dialed)
+
+	_, err = selectServer([]string{"10.0.0.1", "10.0.0.1"}, dial)
+	assert.Error(t, err)
+
+	assert.Equal(t, "10.0.0.1:/export", mountSource("10.0.0.1", "/export"))
+	assert.Equal(t, "[fd00::1]:/export", mountSource("fd00::1", "/export"))
+}
+
+func TestPublishServerFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs-node")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock", dir, filepath.Join(dir, "state"), filepath.Join(dir, "krb5"), 0))
+	mounter := &mount.FakeMounter{}
+	ns.mounter = mounter
+	reachable := map[string]bool{"10.0.0.2": true}
+	ns.dial = func(server string) error {
+		if !reachable[server] {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	targetPath := filepath.Join(dir, "target")
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   "vol",
+		TargetPath: targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeAttributes: map[string]string{"server": "10.0.0.1,10.0.0.2", "share": "/export"},
+	}
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(mounter.MountPoints))
+	assert.Equal(t, "10.0.0.2:/export", mounter.MountPoints[0].Device)
+	assert.Equal(t, "10.0.0.2:/export", ns.getMountSource(targetPath))
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: targetPath})
+	assert.NoError(t, err)
+
+	// Test that no reachable server is reported as unavailable
+	reachable = map[string]bool{}
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Zero(t, len(mounter.MountPoints))
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Volume attributes selecting mount options
+const (
+	attrServer   = "server"
+	attrShare    = "share"
+	attrVers     = "vers"
+	attrUID      = "uid"
+	attrGID      = "gid"
+	attrFileMode = "file_mode"
+	attrDirMode  = "dir_mode"
+)
+
+// Node publish secrets
+const (
+	secretUsername = "username"
+	secretPassword = "password"
+	secretDomain   = "domain"
+)
+
+var (
+	// smbVersions are the SMB protocol versions of the vers mount option,
+	// see mount.cifs(8)
+	smbVersions = []string{"1.0", "2.0", "2.1", "3", "3.0", "3.02", "3.1.1", "default"}
+
+	// optionAttributes are the volume attributes copied to mount options
+	optionAttributes = []string{attrVers, attrUID, attrGID, attrFileMode, attrDirMode}
+
+	// credentialOptions are passed in a credentials file, never in mount
+	// flags, so that they do not show up in the mount table or in logs
+	credentialOptions = []string{"username", "user", "password", "pass", "domain", "dom", "workgroup", "credentials", "cred"}
+)
+
+// mountSource returns the UNC path of the share given by the server and share
+// attributes.
+func mountSource(attributes map[string]string) (string, error) {
+	server := attributes[attrServer]
+	share := strings.Trim(attributes[attrShare], "/")
+	if server == "" || share == "" {
+		return "", fmt.Errorf("volume attributes %q and %q are required", attrServer, attrShare)
+	}
+	if strings.ContainsAny(server, "/\\") {
+		return "", fmt.Errorf("invalid %s %q", attrServer, server)
+	}
+	return fmt.Sprintf("//%s/%s", server, share), nil
+}
+
+// buildMountOptions combines the mount flags of a volume capability with the
+// options selected by volume attributes and validates the result. An option
+// given more than once with the same value is passed once, with different
+// values it is an error naming the offending options.
+func buildMountOptions(attributes map[string]string, flags []string, readOnly bool) ([]string, error) {
+	opts := map[string]string{}
+	options := []string{}
+	add := func(opt string) error {
+		key, value := splitOption(opt)
+		if contains(credentialOptions, key) {
+			return fmt.Errorf("mount option %q must be given in node publish secrets", key)
+		}
+		if prev, ok := opts[key]; ok {
+			if prev != value {
+				return fmt.Errorf("conflicting mount options %q and %q", key+joinValue(prev), opt)
+			}
+			return nil
+		}
+		opts[key] = value
+		options = append(options, opt)
+		return nil
+	}
+
+	for _, flag := range flags {
+		if err := add(flag); err != nil {
+			return nil, err
+		}
+	}
+	for _, attr := range optionAttributes {
+		v, ok := attributes[attr]
+		if !ok {
+			continue
+		}
+		if err := validateAttribute(attr, v); err != nil {
+			return nil, err
+		}
+		if err := add(attr + "=" + v); err != nil {
+			return nil, err
+		}
+	}
+	if _, rw := opts["rw"]; rw && readOnly {
+		return nil, fmt.Errorf("mount option \"rw\" conflicts with a read only volume")
+	}
+	if readOnly {
+		if err := add("ro"); err != nil {
+			return nil, err
+		}
+	}
+	_, ro := opts["ro"]
+	_, rw := opts["rw"]
+	if ro && rw {
+		return nil, fmt.Errorf("conflicting mount options \"ro\" and \"rw\"")
+	}
+	return options, nil
+}
+
+func validateAttribute(attr, value string) error {
+	switch attr {
+	case attrVers:
+		if !contains(smbVersions, value) {
+			return fmt.Errorf("invalid %s %q, expected one of %v", attr, value, smbVersions)
+		}
+	case attrUID, attrGID:
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return fmt.Errorf("invalid %s %q, expected a numeric ID", attr, value)
+		}
+	case attrFileMode, attrDirMode:
+		if _, err := strconv.ParseUint(value, 8, 32); err != nil || len(value) > 4 {
+			return fmt.Errorf("invalid %s %q, expected an octal mode like 0755", attr, value)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func splitOption(opt string) (string, string) {
+	kv := strings.SplitN(opt, "=", 2)
+	if len(kv) == 1 {
+		return kv[0], ""
+	}
+	return kv[0], kv[1]
+}
+
+func joinValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "=" + value
+}
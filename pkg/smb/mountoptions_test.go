@@ -0,0 +1,75 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountSource(t *testing.T) {
+	source, err := mountSource(map[string]string{attrServer: "fileserver", attrShare: "/data/"})
+	assert.NoError(t, err)
+	assert.Equal(t, "//fileserver/data", source)
+
+	_, err = mountSource(map[string]string{attrServer: "fileserver"})
+	assert.Error(t, err)
+	_, err = mountSource(map[string]string{attrServer: `fileserver\data`, attrShare: "data"})
+	assert.Error(t, err)
+}
+
+func TestBuildMountOptions(t *testing.T) {
+	attributes := map[string]string{
+		attrVers:     "3.0",
+		attrUID:      "1000",
+		attrGID:      "1000",
+		attrFileMode: "0640",
+		attrDirMode:  "0750",
+		"other":      "ignored",
+	}
+	options, err := buildMountOptions(attributes, []string{"nounix"}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nounix", "vers=3.0", "uid=1000", "gid=1000", "file_mode=0640", "dir_mode=0750", "ro"}, options)
+
+	// Test that options given twice with the same value are passed once
+	options, err = buildMountOptions(map[string]string{attrVers: "3.0"}, []string{"ro", "vers=3.0"}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ro", "vers=3.0"}, options)
+
+	tests := []struct {
+		attributes map[string]string
+		flags      []string
+		readOnly   bool
+	}{
+		{map[string]string{attrVers: "4"}, nil, false},
+		{map[string]string{attrUID: "alice"}, nil, false},
+		{map[string]string{attrGID: "-1"}, nil, false},
+		{map[string]string{attrFileMode: "0999"}, nil, false},
+		{map[string]string{attrDirMode: "107555"}, nil, false},
+		{map[string]string{attrVers: "3.0"}, []string{"vers=2.1"}, false},
+		{nil, []string{"password=secret"}, false},
+		{nil, []string{"credentials=/etc/creds"}, false},
+		{nil, []string{"rw"}, true},
+		{nil, []string{"ro", "rw"}, false},
+		{nil, []string{"uid=1000", "uid=1001"}, false},
+	}
+	for _, test := range tests {
+		_, err := buildMountOptions(test.attributes, test.flags, test.readOnly)
+		assert.Error(t, err, "%v %v", test.attributes, test.flags)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/kubernetes/pkg/volume/util"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+// nodeServer mounts SMB shares with mount.cifs. The credentials of a share
+// are passed to mount.cifs in a credentials file which is removed once the
+// share is mounted.
+type nodeServer struct {
+	*csicommon.DefaultNodeServer
+	mounter mount.Interface
+}
+
+func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "SMB shares cannot be published as block volumes")
+	}
+
+	source, err := mountSource(req.GetVolumeAttributes())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mo, err := buildMountOptions(req.GetVolumeAttributes(), req.GetVolumeCapability().GetMount().GetMountFlags(), req.GetReadonly())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	credentials, err := writeCredentials(req.GetNodePublishSecrets())
+	if err != nil {
+		return nil, err
+	}
+	if credentials == "" {
+		mo = append(mo, "guest")
+	} else {
+		defer os.Remove(credentials)
+		mo = append(mo, "credentials="+credentials)
+	}
+
+	targetPath := req.GetTargetPath()
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(targetPath, 0750); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
+		} else {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if !notMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	glog.V(4).Infof("smb: mounting %s at %s", source, targetPath)
+	err = ns.mounter.Mount(source, targetPath, "cifs", mo)
+	if err != nil {
+		if os.IsPermission(err) {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		if strings.Contains(err.Error(), "invalid argument") {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+
+	// UnmountPath succeeds for missing and already unmounted targets and
+	// removes the leftover directory
+	if err := util.UnmountPath(req.GetTargetPath(), ns.mounter); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// writeCredentials writes the username, password and domain secrets to a
+// credentials file of mount.cifs readable by root only and returns its path.
+// It returns "" if secrets hold no username. The caller removes the file.
+func writeCredentials(secrets map[string]string) (string, error) {
+	username := secrets[secretUsername]
+	if username == "" {
+		if len(secrets[secretPassword]) != 0 || len(secrets[secretDomain]) != 0 {
+			return "", status.Errorf(codes.InvalidArgument, "secret %q is required with a password or domain", secretUsername)
+		}
+		return "", nil
+	}
+	content := fmt.Sprintf("username=%s\n", username)
+	if password, ok := secrets[secretPassword]; ok {
+		content += fmt.Sprintf("password=%s\n", password)
+	}
+	if domain, ok := secrets[secretDomain]; ok {
+		content += fmt.Sprintf("domain=%s\n", domain)
+	}
+	for _, key := range []string{secretUsername, secretPassword, secretDomain} {
+		if strings.ContainsAny(secrets[key], "\r\n") {
+			return "", status.Errorf(codes.InvalidArgument, "secret %q must not contain line breaks", key)
+		}
+	}
+
+	// TempFile creates the file readable by its owner only
+	f, err := ioutil.TempFile("", "smb-credentials")
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	return f.Name(), nil
+}
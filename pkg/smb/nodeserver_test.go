@@ -0,0 +1,154 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+// credentialsMounter records the content of the credentials file at mount
+// time, the file is removed after mounting.
+type credentialsMounter struct {
+	*csicommon.RecordingMounter
+	credentials string
+}
+
+func (m *credentialsMounter) Mount(source, target, fstype string, options []string) error {
+	for _, opt := range options {
+		if strings.HasPrefix(opt, "credentials=") {
+			path := strings.TrimPrefix(opt, "credentials=")
+			fi, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if fi.Mode().Perm() != 0600 {
+				return os.ErrPermission
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			m.credentials = string(content)
+		}
+	}
+	return m.RecordingMounter.Mount(source, target, fstype, options)
+}
+
+func TestPublishUnpublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smb-node")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock"))
+	mounter := &credentialsMounter{RecordingMounter: csicommon.NewRecordingMounter()}
+	ns.mounter = mounter
+
+	targetPath := filepath.Join(dir, "target")
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   "vol",
+		TargetPath: targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeAttributes:   map[string]string{attrServer: "fileserver", attrShare: "data", attrVers: "3.0"},
+		NodePublishSecrets: map[string]string{secretUsername: "alice", secretPassword: "secret", secretDomain: "CORP"},
+	}
+
+	// Test that a second publish is a no-op
+	for i := 0; i < 2; i++ {
+		_, err = ns.NodePublishVolume(context.Background(), req)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, len(mounter.MountPoints))
+	mp := mounter.MountPoints[0]
+	assert.Equal(t, "//fileserver/data", mp.Device)
+	assert.Equal(t, "cifs", mp.Type)
+	assert.Equal(t, "username=alice\npassword=secret\ndomain=CORP\n", mounter.credentials)
+
+	// Test that the credentials are not passed as options and are removed
+	credentials := ""
+	for _, opt := range mounter.Opts[targetPath] {
+		assert.False(t, strings.Contains(opt, "secret"), opt)
+		if strings.HasPrefix(opt, "credentials=") {
+			credentials = strings.TrimPrefix(opt, "credentials=")
+		}
+	}
+	assert.NotEmpty(t, credentials)
+	_, err = os.Stat(credentials)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test that unpublish is idempotent
+	for i := 0; i < 2; i++ {
+		_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: targetPath})
+		assert.NoError(t, err)
+	}
+	assert.Zero(t, len(mounter.MountPoints))
+
+	// Test a guest mount
+	req.NodePublishSecrets = nil
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Contains(t, mounter.Opts[targetPath], "guest")
+}
+
+func TestPublishInvalid(t *testing.T) {
+	ns := NewNodeServer(NewDriver("node", "unix://tmp/csi.sock"))
+	ns.mounter = &mount.FakeMounter{}
+	mountCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}
+	attributes := map[string]string{attrServer: "fileserver", attrShare: "data"}
+
+	tests := []*csi.NodePublishVolumeRequest{
+		{TargetPath: "/mnt/smb", VolumeCapability: mountCap, VolumeAttributes: attributes},
+		{VolumeId: "vol", VolumeCapability: mountCap, VolumeAttributes: attributes},
+		{VolumeId: "vol", TargetPath: "/mnt/smb", VolumeAttributes: attributes},
+		{VolumeId: "vol", TargetPath: "/mnt/smb", VolumeCapability: mountCap},
+		{
+			VolumeId:   "vol",
+			TargetPath: "/mnt/smb",
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			},
+			VolumeAttributes: attributes,
+		},
+		{
+			VolumeId:           "vol",
+			TargetPath:         "/mnt/smb",
+			VolumeCapability:   mountCap,
+			VolumeAttributes:   attributes,
+			NodePublishSecrets: map[string]string{secretPassword: "secret"},
+		},
+	}
+	for _, req := range tests {
+		_, err := ns.NodePublishVolume(context.Background(), req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "%v", req)
+	}
+}